@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"path/filepath"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
 
 	atf "github.com/leogem2003/allthoughtsfiles"
 
@@ -16,6 +19,12 @@ func TestMain(m *testing.M) {
 	atf.MakePlayground(root1, []string{"a/f1.txt", "a/f2.txt", "b/f1.txt"})
 	root2 = atf.GetTmpName([]string{"atf", "test_cli", "dest"})
 	atf.MakePlayground(root2, []string{""})
+	for _, root := range []string{root1, root2} {
+		if err := InitFolder(root, &atf.FolderConfig{}); err != nil {
+			fmt.Printf("Error while initializing %s: %v", root, err)
+			os.Exit(1)
+		}
+	}
 	var err error
 	settingsPath, err = atf.MakeSettings("atf")
 	if err != nil {
@@ -30,19 +39,292 @@ func TestMain(m *testing.M) {
 }
 
 func Test(t *testing.T) {
-	arg1 := []string{"run", "main.go", "--debug", "--settings", settingsPath, root1}
-	arg2 := []string{"run", "main.go", "--debug", "--settings", settingsPath, root2}
+	arg1 := []string{"run", ".", "sync", "--debug", "--settings", settingsPath, root1}
+	arg2 := []string{"run", ".", "sync", "--debug", "--settings", settingsPath, root2}
 	atf.RunPrg(arg1,arg2,t)
-	atf.CheckEqual(root1,root2,t)	
+	atf.CheckSynced(root1, root2, t)	
 	
 	os.WriteFile(filepath.Join(root1, "a/f1.txt"), []byte("a"), 0644)
 	os.WriteFile(filepath.Join(root2, "b/f1.txt"), []byte("b"), 0644)
 	atf.RunPrg(arg1,arg2,t)		
-	atf.CheckEqual(root1,root2,t)
+	atf.CheckSynced(root1, root2, t)
 
 	os.Remove(filepath.Join(root1, "a/f1.txt"))
 	os.Remove(filepath.Join(root2, "b/f1.txt"))
 	atf.RunPrg(arg1,arg2,t)
-	atf.CheckEqual(root1,root2,t)
+	atf.CheckSynced(root1, root2, t)
 }
 
+
+func TestServeSet(t *testing.T) {
+	root := atf.GetTmpName([]string{"atf", "test_serve"})
+	atf.MakePlayground(root, []string{"a/f1.txt", "a/f2.txt", "db"+DBNAME})
+	defer os.RemoveAll(root)
+
+	policy := atf.ExcludeSuffix(DBNAME)
+	changed := []string{"a/f1.txt", "db" + DBNAME, "../f1.txt", "/etc/passwd"}
+	allowed := ServeSet(root, changed, policy)
+
+	if len(allowed) != 1 || !allowed["a/f1.txt"] {
+		t.Errorf("Unexpected serve set: %v", allowed)
+	}
+	if allowed["a/f2.txt"] {
+		t.Errorf("Path outside of the change set is serveable")
+	}
+}
+
+func TestFolderStatus(t *testing.T) {
+	root := atf.GetTmpName([]string{"atf", "test_status"})
+	atf.MakePlayground(root, []string{"a/f1.txt", "a/f2.txt", "b.txt", "c.txt"})
+	defer os.RemoveAll(root)
+
+	if _, err := FolderStatus(root); err == nil {
+		t.Fatalf("Got the status of a folder never initialized")
+	}
+	if err := InitFolder(root, &atf.FolderConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitFolder(root, &atf.FolderConfig{}); err == nil {
+		t.Errorf("Initialized a folder twice")
+	}
+	status, err := FolderStatus(root)
+	if err != nil || len(status.Added) != 5 {
+		t.Fatalf("After init everything is added: %+v (%v)", status, err)
+	}
+
+	cache := atf.LoadScanCache(GetCacheFile(root))
+	stats, err := atf.CreateStatsCached(os.DirFS(root), ".", FolderPolicy(&atf.IgnoreRules{}), 0, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SaveStats(root, stats, cache)
+	if status, err := FolderStatus(root); err != nil || len(status.Added)+len(status.Deleted)+len(status.Modified)+len(status.Metadata) != 0 {
+		t.Fatalf("Expected no changes, got %+v (%v)", status, err)
+	}
+
+	os.WriteFile(filepath.Join(root, "a/f1.txt"), []byte("new"), 0644)
+	os.Remove(filepath.Join(root, "a/f2.txt"))
+	os.WriteFile(filepath.Join(root, "d.txt"), []byte{}, 0644)
+	os.Chmod(filepath.Join(root, "b.txt"), 0600)
+	status, err = FolderStatus(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Status{
+		Added:    []string{"d.txt"},
+		Deleted:  []string{filepath.Join("a", "f2.txt")},
+		Modified: []string{filepath.Join("a", "f1.txt")},
+		Metadata: []string{"a", "b.txt"},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, status)
+	}
+}
+
+func TestSplitSelection(t *testing.T) {
+	x, y := filepath.Join("a", "x"), filepath.Join("a", "y")
+	z := filepath.Join("b", "z")
+	oldStats := atf.Stats{
+		"a": {Name: "a", IsDir: true},
+		x:   {Name: "x", Size: 1, Digest: "1"},
+		y:   {Name: "y", Size: 1, Digest: "1"},
+		z:   {Name: "z", Size: 1, Digest: "1", Remote: true},
+		"c": {Name: "c", Size: 1, Digest: "1"},
+	}
+	newStats := atf.Stats{
+		"a": {Name: "a", IsDir: true},
+		x:   {Name: "x", Size: 1, Digest: "1"},
+		y:   {Name: "y", Size: 2, Digest: "2"},
+		"c": {Name: "c", Size: 1, Digest: "1"},
+	}
+	config := &atf.FolderConfig{Selective: true, Select: []string{"b", "c"}}
+	remoteOnly, deselected, wanted := SplitSelection(config, oldStats, newStats)
+
+	// a/y changed since the last sync: it is neither synced nor removed
+	slices.Sort(deselected)
+	if !reflect.DeepEqual(deselected, []string{"a", x}) {
+		t.Errorf("Unexpected deselected entries %v", deselected)
+	}
+	if !reflect.DeepEqual(wanted, []string{z}) {
+		t.Errorf("Unexpected wanted entries %v", wanted)
+	}
+	if len(remoteOnly) != 3 || !remoteOnly[x].Remote || !remoteOnly[z].Remote {
+		t.Errorf("Unexpected remote-only entries %v", remoteOnly)
+	}
+	if _, ok := remoteOnly[y]; ok {
+		t.Errorf("Changed entry %s taken as remote-only", y)
+	}
+	for _, stats := range []atf.Stats{oldStats, newStats} {
+		if len(stats) != 1 || stats["c"].Name != "c" {
+			t.Errorf("Only the selected entries must be left, got %v", stats)
+		}
+	}
+
+	// without a selection, nothing is split
+	remoteOnly, deselected, wanted = SplitSelection(&atf.FolderConfig{}, atf.Stats{"c": {}}, atf.Stats{"c": {}})
+	if len(remoteOnly)+len(deselected)+len(wanted) != 0 {
+		t.Errorf("Entries split without a selection")
+	}
+}
+
+func TestWantedPaths(t *testing.T) {
+	tagger, err := atf.NewTagger([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := atf.Stats{"a": {}, "b": {}}
+	tags := []string{tagger.Path("b"), tagger.Path("missing"), tagger.Path("a")}
+	if paths := WantedPaths(tagger, stats, tags); !reflect.DeepEqual(paths, []string{"b", "a"}) {
+		t.Errorf("Unexpected paths %v", paths)
+	}
+	// paths are their own tags without a folder secret
+	if paths := WantedPaths(nil, stats, []string{"a", "c"}); !reflect.DeepEqual(paths, []string{"a"}) {
+		t.Errorf("Unexpected paths %v", paths)
+	}
+}
+
+func TestExchangeWanted(t *testing.T) {
+	tagger, err := atf.NewTagger([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "x" is remote-only on both sides: neither can serve it, but both
+	// still have to agree there is something to sync
+	p1, p2 := atf.MakePipes(4)
+	type result struct {
+		paths []string
+		any   bool
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		paths, any, err := ExchangeWanted(p2, tagger, atf.Stats{"a": {}}, nil)
+		done <- result{paths, any, err}
+	}()
+	paths, any, err := ExchangeWanted(p1, tagger, atf.Stats{"b": {}}, []string{"x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-done
+	if peer.err != nil {
+		t.Fatal(peer.err)
+	}
+	if len(paths) != 0 || len(peer.paths) != 0 {
+		t.Errorf("Unexpected wanted paths %v and %v", paths, peer.paths)
+	}
+	if !any || !peer.any {
+		t.Errorf("Peers disagree on stopping early: %v and %v", any, peer.any)
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	dir := t.TempDir()
+	syncLog, err := atf.OpenSyncLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the latest unresolved conflict of a path is resolved, and checked
+	syncLog.Add(atf.SyncEvent{Conflicts: []atf.Conflict{{Path: "f", Winner: atf.LocalSide}, {Path: "g", Winner: atf.LocalSide}}})
+	syncLog.Add(atf.SyncEvent{Conflicts: []atf.Conflict{{Path: "f", Winner: atf.RemoteSide}, {Path: "g", Winner: atf.RemoteSide, Resolved: true}}})
+	if err := syncLog.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResolveCommand([]string{"-keep", "remote", dir, "f"}); err != nil {
+		t.Errorf("Cannot keep the remote version won by the latest conflict: %v", err)
+	}
+	if err := ResolveCommand([]string{"-keep", "remote", dir, "g"}); err == nil || !strings.Contains(err.Error(), "on the peer") {
+		t.Errorf("Kept the remote version replaced locally: %v", err)
+	}
+	if syncLog, err = atf.OpenSyncLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncLog.Resolve("g"); err != nil {
+		t.Errorf("Rejected conflict resolved: %v", err)
+	}
+	if _, err := syncLog.Resolve("f"); err == nil {
+		t.Errorf("Conflict left unresolved")
+	}
+}
+
+func TestFolderModes(t *testing.T) {
+	root := atf.GetTmpName([]string{"atf", "test_modes"})
+	atf.MakePlayground(root, []string{"a/f1.txt", "a/f2.txt", "b.txt"})
+	defer os.RemoveAll(root)
+	if err := InitFolder(root, &atf.FolderConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	ignore := &atf.IgnoreRules{}
+	policy := FolderPolicy(ignore)
+	cache := atf.LoadScanCache(GetCacheFile(root))
+	stats, err := atf.CreateStatsCached(os.DirFS(root), ".", policy, 0, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SaveStats(root, stats, cache)
+	trash, err := atf.OpenTrash(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f1, f2 := filepath.Join("a", "f1.txt"), filepath.Join("a", "f2.txt")
+	os.WriteFile(filepath.Join(root, f1), []byte("new"), 0644)
+	os.Remove(filepath.Join(root, f2))
+	os.WriteFile(filepath.Join(root, "c.txt"), []byte{}, 0644)
+	scan := func() (atf.Stats, atf.Stats, *FolderChanges) {
+		oldStats, err := LoadStats(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newStats := make(atf.Stats)
+		var scanErr error
+		added, deleted, modified := LocalChanges(oldStats, atf.TeeStats(cache.Seq(os.DirFS(root), ".", policy, 0, &scanErr), newStats), ignore)
+		if scanErr != nil {
+			t.Fatal(scanErr)
+		}
+		return oldStats, newStats, &FolderChanges{Added: added, Deleted: deleted, Modified: modified, Wanted: []string{"w"}}
+	}
+
+	oldStats, newStats, changes := scan()
+	expected := &FolderChanges{Added: []string{"c.txt"}, Deleted: []string{f2}, Modified: []string{"a", f1}, Wanted: []string{"w"}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, changes)
+	}
+
+	// send-only: the changes are sent, nothing is wanted
+	if err := ApplyMode(root, atf.SendOnly, false, trash, oldStats, newStats, changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Wanted) != 0 || len(changes.Added)+len(changes.Deleted)+len(changes.Modified) != 4 {
+		t.Errorf("Unexpected send-only changes %+v", changes)
+	}
+
+	// receive-only: nothing is sent, and the database keeps the synced state
+	oldStats, newStats, changes = scan()
+	if err := ApplyMode(root, atf.ReceiveOnly, false, trash, oldStats, newStats, changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Added)+len(changes.Deleted)+len(changes.Modified)+len(changes.Reverted) != 0 || len(changes.Wanted) != 1 {
+		t.Errorf("Unexpected receive-only changes %+v", changes)
+	}
+	if _, ok := newStats["c.txt"]; ok || newStats[f1] != oldStats[f1] || newStats[f2] != oldStats[f2] {
+		t.Errorf("Local changes recorded in the database: %v", newStats)
+	}
+	if _, err := os.Stat(filepath.Join(root, "c.txt")); err != nil {
+		t.Errorf("Added file removed without reverting: %v", err)
+	}
+
+	// reverted: added files go to the trash, the others are wanted back
+	oldStats, newStats, changes = scan()
+	if err := ApplyMode(root, atf.ReceiveOnly, true, trash, oldStats, newStats, changes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes.Wanted, []string{"w", f2, f1}) || !changes.Reverted[f1] || !changes.Reverted[f2] {
+		t.Errorf("Unexpected reverted changes %+v", changes)
+	}
+	if _, err := os.Stat(filepath.Join(root, "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("Added file not reverted: %v", err)
+	}
+	if entries := trash.Entries; len(entries) != 1 || entries[0].Path != "c.txt" {
+		t.Errorf("Added file not trashed: %v", entries)
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"iter"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	atf "github.com/leogem2003/allthoughtsfiles"
+)
+
+// Subcommand of atf
+type Command struct {
+	Name string
+	Help string // one line summary
+	Run  func(args []string) error
+}
+
+// Returns the flags of the command name, whose usage shows its
+// arguments and help
+func commandFlags(name, arguments, help string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [OPTIONS] %s\n%s\n", os.Args[0], name, arguments, help)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Parses the flags of a command, which may follow its arguments.
+// Returns the arguments.
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	positional := make([]string, 0)
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// Parses the flags and arguments of a command, exiting with its usage
+// unless there are between min and max arguments, max < 0 being unbounded
+func commandArgs(flags *flag.FlagSet, args []string, min, max int) []string {
+	positional := parseArgs(flags, args)
+	if len(positional) < min || (max >= 0 && len(positional) > max) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return positional
+}
+
+// Fails unless dir was initialized
+func checkFolder(dir string) error {
+	_, err := os.Stat(GetStatsDB(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is not an atf folder: run 'atf init %s' first", dir, dir)
+	}
+	return err
+}
+
+// Creates the database of a folder: init <dir>
+func InitCommand(args []string) error {
+	flags := commandFlags("init", "<dir>",
+		"Creates the database of a folder, created if missing, so that it can be synced.\n"+
+			"Its files are sent to the peer by the first sync")
+	mode := flags.String("mode", "", "folder mode: send-receive, send-only or receive-only")
+	selection := make([]string, 0)
+	flags.Func("select", "only sync this subfolder (repeatable)", func(p string) error {
+		selection = append(selection, p)
+		return nil
+	})
+	dir := commandArgs(flags, args, 1, 1)[0]
+
+	config, err := atf.LoadFolderConfig(GetConfigFile(dir))
+	if err != nil {
+		return err
+	}
+	if *mode != "" {
+		if config.Mode, err = atf.ParseFolderMode(*mode); err != nil {
+			return err
+		}
+	}
+	for _, p := range selection {
+		if err := config.AddSelection(p); err != nil {
+			return fmt.Errorf("cannot select %s: %w", p, err)
+		}
+	}
+	return InitFolder(dir, config)
+}
+
+// Creates the empty database of dir and saves its config
+func InitFolder(dir string, config *atf.FolderConfig) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	db, err := os.OpenFile(GetStatsDB(dir), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s is already an atf folder", dir)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = db.WriteString("{}")
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return config.Save(GetConfigFile(dir))
+}
+
+// Shows or changes the settings of a folder: config <dir>
+func ConfigCommand(args []string) error {
+	flags := commandFlags("config", "<dir>",
+		"Shows the settings of a folder, after changing the ones given")
+	mode := flags.String("mode", "", "folder mode: send-receive, send-only or receive-only")
+	selectAdd, selectRemove := make([]string, 0), make([]string, 0)
+	flags.Func("select-add", "add a subfolder to the selective sync (repeatable)", func(p string) error {
+		selectAdd = append(selectAdd, p)
+		return nil
+	})
+	flags.Func("select-remove", "remove a subfolder from the selective sync (repeatable)", func(p string) error {
+		selectRemove = append(selectRemove, p)
+		return nil
+	})
+	conflicts := flags.String("conflicts", "", "how conflicts are solved: latest or copy")
+	trashDays := flags.Int("trash-days", 0, "days deleted files are kept in the trash, 0 for ever")
+	trashMaxSize := flags.Int64("trash-max-size", 0, "maximum size in bytes of the trash, 0 for unbounded")
+	versionsDays := flags.Int("versions-days", 0,
+		fmt.Sprintf("days older versions of files are kept, 0 for %d", atf.DefaultVersionsDays))
+	dir := commandArgs(flags, args, 1, 1)[0]
+	if err := checkFolder(dir); err != nil {
+		return err
+	}
+
+	config, err := atf.LoadFolderConfig(GetConfigFile(dir))
+	if err != nil {
+		return err
+	}
+	if *mode != "" {
+		if config.Mode, err = atf.ParseFolderMode(*mode); err != nil {
+			return err
+		}
+	}
+	if *conflicts != "" {
+		if config.Conflicts, err = atf.ParseConflictStrategy(*conflicts); err != nil {
+			return err
+		}
+	}
+	for _, p := range selectAdd {
+		if err := config.AddSelection(p); err != nil {
+			return fmt.Errorf("cannot select %s: %w", p, err)
+		}
+	}
+	for _, p := range selectRemove {
+		if err := config.RemoveSelection(p); err != nil {
+			return fmt.Errorf("cannot deselect %s: %w", p, err)
+		}
+	}
+	changed := false
+	flags.Visit(func(f *flag.Flag) {
+		changed = true
+		switch f.Name {
+		case "trash-days":
+			config.Trash.Days = *trashDays
+		case "trash-max-size":
+			config.Trash.MaxSize = *trashMaxSize
+		case "versions-days":
+			config.VersionsDays = *versionsDays
+		}
+	})
+	if config.Trash.Days < 0 || config.Trash.MaxSize < 0 || config.VersionsDays < 0 {
+		return errors.New("retention limits cannot be negative")
+	}
+	if changed {
+		if err := config.Save(GetConfigFile(dir)); err != nil {
+			return fmt.Errorf("cannot save the folder config: %w", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// Changes on disk since the last sync, as printed by status
+type Status struct {
+	Added    []string `json:"added"`
+	Deleted  []string `json:"deleted"`
+	Modified []string `json:"modified"`
+	Metadata []string `json:"metadata"` // same content, other mode or times
+}
+
+// Compares dir with its database, without any network: status <dir>.
+// Exits with 0 if nothing changed, 1 if something did and 2 on error.
+func StatusCommand(args []string) error {
+	flags := commandFlags("status", "<dir>",
+		"Lists the changes since the last sync, without connecting to the peer.\n"+
+			"Exits with 0 if nothing changed, 1 if something did and 2 on error")
+	asJSON := flags.Bool("json", false, "print the changes as JSON")
+	dir := commandArgs(flags, args, 1, 1)[0]
+	status, err := FolderStatus(dir)
+	if err != nil {
+		errorLog.Printf("%v", err)
+		os.Exit(2)
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			errorLog.Printf("%v", err)
+			os.Exit(2)
+		}
+		fmt.Println(string(data))
+	} else {
+		for kind, p := range status.All() {
+			fmt.Printf("%-9s %s\n", kind, p)
+		}
+	}
+	if len(status.Added)+len(status.Deleted)+len(status.Modified)+len(status.Metadata) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// Yields the kind of each change and its path
+func (s *Status) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, kind := range []struct {
+			name  string
+			paths []string
+		}{
+			{"added", s.Added},
+			{"deleted", s.Deleted},
+			{"modified", s.Modified},
+			{"metadata", s.Metadata},
+		} {
+			for _, p := range kind.paths {
+				if !yield(kind.name, p) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Scans dir and compares it with its database
+func FolderStatus(dir string) (*Status, error) {
+	oldStats, newStats, ignore, err := scanFolder(dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewStatus(oldStats, newStats, ignore), nil
+}
+
+// Returns the changes from oldStats to newStats
+func NewStatus(oldStats, newStats atf.Stats, ignore *atf.IgnoreRules) *Status {
+	status := new(Status)
+	status.Added, status.Deleted, status.Modified = LocalChanges(oldStats, atf.SortedStats(newStats), ignore)
+	status.Metadata = make([]string, 0)
+	status.Modified = slices.DeleteFunc(status.Modified, func(p string) bool {
+		old, info := oldStats[p], newStats[p]
+		sameContent := info.IsDir ||
+			(old.Digest != "" && old.Digest == info.Digest && old.Size == info.Size)
+		if sameContent {
+			status.Metadata = append(status.Metadata, p)
+		}
+		return sameContent
+	})
+	return status
+}
+
+// Loads the database of dir and scans it, keeping the synced entries
+func scanFolder(dir string) (oldStats, newStats atf.Stats, ignore *atf.IgnoreRules, err error) {
+	if err := checkFolder(dir); err != nil {
+		return nil, nil, nil, err
+	}
+	ignore, err = atf.LoadIgnoreRules(dir)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot read %s files: %w", atf.IgnoreFile, err)
+	}
+	config, err := atf.LoadFolderConfig(GetConfigFile(dir))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	oldStats, err = LoadStats(dir)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot load the folder database: %w", err)
+	}
+	cache := atf.LoadScanCache(GetCacheFile(dir))
+	newStats, err = atf.CreateStatsCached(os.DirFS(dir), ".", FolderPolicy(ignore), 0, cache)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot scan %s: %w", dir, err)
+	}
+	if err := cache.Save(); err != nil {
+		warnLog.Printf("Cannot save the scan cache: %v", err)
+	}
+
+	// remote-only entries and the ones outside the selection are not synced
+	for p, info := range oldStats {
+		if info.Remote || !config.Selected(p) {
+			delete(oldStats, p)
+		}
+	}
+	for p := range newStats {
+		if !config.Selected(p) {
+			delete(newStats, p)
+		}
+	}
+	return oldStats, newStats, ignore, nil
+}
+
+// Shows the metadata of the changed entries: diff <dir> [path...]
+func DiffCommand(args []string) error {
+	flags := commandFlags("diff", "<dir> [path...]",
+		"Shows the metadata of the entries changed since the last sync, before and after.\n"+
+			"With paths, only the changes within them are shown")
+	positional := commandArgs(flags, args, 1, -1)
+	dir, paths := positional[0], positional[1:]
+	for i, p := range paths {
+		paths[i] = filepath.Clean(p)
+	}
+	oldStats, newStats, ignore, err := scanFolder(dir)
+	if err != nil {
+		return err
+	}
+
+	for kind, p := range NewStatus(oldStats, newStats, ignore).All() {
+		if len(paths) > 0 && !slices.ContainsFunc(paths, func(q string) bool {
+			return p == q || strings.HasPrefix(p, q+string(filepath.Separator))
+		}) {
+			continue
+		}
+		fmt.Printf("%s %s\n", kind, p)
+		var old, info *atf.FileInfo
+		if i, ok := oldStats[p]; ok {
+			old = &i
+		}
+		if i, ok := newStats[p]; ok {
+			info = &i
+		}
+		printInfoDiff(old, info)
+	}
+	return nil
+}
+
+// Prints the fields of the metadata of an entry that differ, nil for a
+// missing entry
+func printInfoDiff(old, info *atf.FileInfo) {
+	fields := []struct {
+		name   string
+		format func(*atf.FileInfo) string
+	}{
+		{"size", func(i *atf.FileInfo) string { return fmt.Sprint(i.Size) }},
+		{"mode", func(i *atf.FileInfo) string { return i.Mode.String() }},
+		{"modified", func(i *atf.FileInfo) string { return i.ModTime.Local().Format(time.DateTime) }},
+		{"digest", func(i *atf.FileInfo) string { return i.Digest }},
+	}
+	for _, field := range fields {
+		var before, after string
+		if old != nil {
+			before = field.format(old)
+		}
+		if info != nil {
+			after = field.format(info)
+		}
+		switch {
+		case before == after:
+		case old == nil:
+			fmt.Printf("    %-9s %s\n", field.name, after)
+		case info == nil:
+			fmt.Printf("    %-9s %s\n", field.name, before)
+		default:
+			fmt.Printf("    %-9s %s -> %s\n", field.name, before, after)
+		}
+	}
+}
+
+// Lists the past syncs of a folder: log <dir>
+func LogCommand(args []string) error {
+	flags := commandFlags("log", "<dir>", "Lists the past syncs of a folder, newest first")
+	n := flags.Int("n", 20, "number of syncs listed, 0 for all")
+	asJSON := flags.Bool("json", false, "print the syncs as JSON")
+	dir := commandArgs(flags, args, 1, 1)[0]
+	syncLog, err := atf.OpenSyncLog(dir)
+	if err != nil {
+		return err
+	}
+	events := slices.Clone(syncLog.Events)
+	slices.Reverse(events)
+	if *n > 0 && len(events) > *n {
+		events = events[:*n]
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(events, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	for _, e := range events {
+		fmt.Printf("%s  %s  sent %d, received %d, deleted %d\n",
+			e.Time.Local().Format(time.DateTime), e.Peer, e.Sent, e.Received, e.Deleted)
+		for _, c := range e.Conflicts {
+			fmt.Printf("    conflict  %s kept  %s\n", c.Winner, c.Path)
+			if c.Copy != "" {
+				fmt.Printf("              local copy  %s\n", c.Copy)
+			}
+		}
+	}
+	return nil
+}
+
+// Lists or forgets the known peers: peers
+func PeersCommand(args []string) error {
+	flags := commandFlags("peers", "",
+		"Lists the fingerprint of this device and of the peers met so far, by the signaling key they were met on")
+	var settingsPath string
+	atf.SettingsFlag(flags, &settingsPath)
+	forget := flags.String("forget", "", "forget the peer met on this key: the next device met on it is trusted")
+	commandArgs(flags, args, 0, 0)
+
+	identity, peers, err := atf.LoadDevice(filepath.Dir(settingsPath))
+	if err != nil {
+		return fmt.Errorf("cannot load device identity: %w", err)
+	}
+	if *forget != "" {
+		return peers.Forget(*forget)
+	}
+	fmt.Printf("%-20s %s\n", "(this device)", identity.Fingerprint())
+	all := peers.All()
+	for _, name := range slices.Sorted(maps.Keys(all)) {
+		fmt.Printf("%-20s %s\n", name, all[name])
+	}
+	return nil
+}
+
+// Lists or resolves the conflicts of past syncs: resolve <dir> [path]
+func ResolveCommand(args []string) error {
+	flags := commandFlags("resolve", "<dir> [path]",
+		"Lists the conflicts of a folder, solved by keeping the latest version.\n"+
+			"With a path, resolves its conflict keeping a side: the version kept is sent to the peer by the next sync")
+	keep := flags.String("keep", "", "version to keep: local or remote (required with a path)")
+	positional := commandArgs(flags, args, 1, 2)
+	dir := positional[0]
+	syncLog, err := atf.OpenSyncLog(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) == 1 {
+		conflicts, times := syncLog.Conflicts()
+		for i, c := range conflicts {
+			kept := string(c.Winner)
+			if c.Deleted && c.Winner == atf.RemoteSide {
+				kept = "deletion"
+			}
+			fmt.Printf("%s  %-8s kept  %s\n", times[i].Local().Format(time.DateTime), kept, c.Path)
+		}
+		return nil
+	}
+	side := atf.ConflictSide(*keep)
+	if side != atf.LocalSide && side != atf.RemoteSide {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// the log is only saved once the conflict is resolved
+	conflict, err := syncLog.Resolve(positional[1])
+	if err != nil {
+		return err
+	}
+	// the version of the peer was replaced there, and is kept only by it
+	if side == atf.RemoteSide && conflict.Winner == atf.LocalSide && !conflict.Deleted {
+		return fmt.Errorf("the version of %s of the peer was replaced there: resolve the conflict on the peer, keeping the local version", conflict.Path)
+	}
+	if err := keepSide(dir, conflict, side); err != nil {
+		return err
+	}
+	return syncLog.Save()
+}
+
+// Makes the version of side the current one of a conflict. The remote
+// side of a file the local side won is only kept by the peer, and must
+// be rejected beforehand.
+func keepSide(dir string, c atf.Conflict, side atf.ConflictSide) error {
+	if side == c.Winner {
+		return nil
+	}
+	trash, err := atf.OpenTrash(dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case side == atf.RemoteSide && c.Deleted:
+		if err := trash.Move(c.Path, "resolved"); err != nil {
+			return err
+		}
+		return trash.Save()
+	case c.Deleted:
+		// the local version was trashed when the peer deleted it
+		if err := trash.Restore(c.Path); err != nil {
+			return err
+		}
+		return trash.Save()
+	}
+	// the local version was archived when replaced
+	if c.Version == "" {
+		return fmt.Errorf("the local version of %s was not recorded: find it with 'atf history' and 'atf restore' it", c.Path)
+	}
+	versions, err := atf.OpenVersions(dir)
+	if err != nil {
+		return err
+	}
+	if err := versions.RestoreFile(c.Path, c.Version); err != nil {
+		return err
+	}
+	return versions.Save()
+}
+
+// Runs the trash actions: trash list <dir> and trash restore <dir> <path>
+func TrashCommand(args []string) error {
+	flags := commandFlags("trash", "list <dir> | restore <dir> <path>",
+		"Lists or restores the deleted files of a folder")
+	positional := commandArgs(flags, args, 2, 3)
+	if (positional[0] == "restore") != (len(positional) == 3) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	trash, err := atf.OpenTrash(positional[1])
+	if err != nil {
+		return err
+	}
+	switch positional[0] {
+	case "list":
+		for _, e := range trash.Entries {
+			fmt.Printf("%s  %-13s %10d  %s\n", e.Trashed.Local().Format(time.DateTime), e.Reason, e.Size, e.Path)
+		}
+		return nil
+	case "restore":
+		if err := trash.Restore(positional[2]); err != nil {
+			return err
+		}
+		return trash.Save()
+	}
+	return fmt.Errorf("unknown trash action %q", positional[0])
+}
+
+// Lists the versions of a file: history <dir> <path>
+func HistoryCommand(args []string) error {
+	flags := commandFlags("history", "<dir> <path>",
+		"Lists the older versions of a file, replaced by the ones of peers")
+	positional := commandArgs(flags, args, 2, 2)
+	versions, err := atf.OpenVersions(positional[0])
+	if err != nil {
+		return err
+	}
+	history := versions.History(positional[1])
+	if len(history) == 0 {
+		return fmt.Errorf("%s has no older versions", positional[1])
+	}
+	for i, v := range history {
+		source := v.Source
+		if source == "" {
+			source = "this device"
+		}
+		fmt.Printf("%3d  %s  %10d  %s\n", i+1, v.ModTime.Local().Format(time.DateTime), v.Size, source)
+	}
+	return nil
+}
+
+// Restores a version of a file: restore <dir> <path>.
+// The file is sent to the peers by the next sync.
+func RestoreCommand(args []string) error {
+	flags := commandFlags("restore", "<dir> <path>",
+		"Restores an older version of a file, sent to the peer by the next sync")
+	version := flags.Int("version", 1, "version to restore, as numbered by history")
+	positional := commandArgs(flags, args, 2, 2)
+	versions, err := atf.OpenVersions(positional[0])
+	if err != nil {
+		return err
+	}
+	if err := versions.Restore(positional[1], *version); err != nil {
+		return err
+	}
+	return versions.Save()
+}
@@ -1,164 +1,968 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
 	"io"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"flag"
+	"io/fs"
+	"iter"
 	"log"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
 	"sort"
-	"strings"
 	"sync"
+	"time"
 
 	atf "github.com/leogem2003/allthoughtsfiles"
 	dc "github.com/leogem2003/directchan"
 )
 
 const DBNAME = ".allthoughtsfile"
+const SALTNAME = DBNAME + "-salt"
+const CACHENAME = DBNAME + "-cache"
+const CONFIGNAME = DBNAME + "-config"
 const CHUNK_SIZE = 1024
+const MAX_RETRIES = 3
 var ACK = []byte(":ACK")
+var ERR = []byte(":ERR ")
 var Usage = func() {
-	fmt.Printf("Usage: %s [OPTIONS] <dir>\nSynchronizes a directory across devices\n", os.Args[0]) 
-	flag.PrintDefaults()
-}	
+	fmt.Printf("Usage: %s <command> [OPTIONS] [ARGS]\nSynchronizes a directory across devices\n\nCommands:\n", os.Args[0])
+	for _, command := range Commands {
+		fmt.Printf("  %-9s %s\n", command.Name, command.Help)
+	}
+	fmt.Printf("\nRun '%s <command> -h' for the options of a command\n", os.Args[0])
+}
+
+var Commands = []Command{
+	{"init", "creates the database of a folder", InitCommand},
+	{"sync", "synchronizes a folder with a peer", SyncCommand},
+	{"status", "lists the changes since the last sync", StatusCommand},
+	{"diff", "shows the metadata of the changes since the last sync", DiffCommand},
+	{"log", "lists the past syncs of a folder", LogCommand},
+	{"peers", "lists or forgets the known peers", PeersCommand},
+	{"resolve", "lists or resolves the conflicts of past syncs", ResolveCommand},
+	{"config", "shows or changes the settings of a folder", ConfigCommand},
+	{"revert", "undoes the local changes of a receive-only folder", RevertCommand},
+	{"trash", "lists or restores the deleted files of a folder", TrashCommand},
+	{"history", "lists the older versions of a file", HistoryCommand},
+	{"restore", "restores an older version of a file", RestoreCommand},
+}
 
 var errorLog = log.New(os.Stderr, "ERROR: ", 0)
-var SendLock = make(chan bool, 1)
+var warnLog = log.New(os.Stderr, "WARNING: ", 0)
 
 func main() {
-	var settingsPath string
-	var debug bool
-	var create bool
-	
-	atf.SettingsFlag(&settingsPath)
-	atf.DebugFlag(&debug)
-	flag.BoolVar(&create, "create", false, "create a new db")
-
 	flag.Usage = Usage
 	flag.Parse()
+	if flag.NArg() == 0 {
+		Usage()
+		os.Exit(2)
+	}
+	for _, command := range Commands {
+		if command.Name == flag.Arg(0) {
+			if err := command.Run(flag.Args()[1:]); err != nil {
+				errorLog.Fatalf("%v", err)
+			}
+			return
+		}
+	}
+	errorLog.Printf("Unknown command %q", flag.Arg(0))
+	Usage()
+	os.Exit(2)
+}
+
+// Synchronizes folders with their peers: sync [dir]
+func SyncCommand(args []string) error {
+	return syncFolder(commandFlags("sync", "[dir]",
+		"Synchronizes a folder with the peer met on the signaling key of the settings.\n"+
+			"Without a folder, synchronizes every folder declared in the settings with each of its peers"), args, false)
+}
+
+// Syncs a receive-only folder undoing its local changes: revert <dir>
+func RevertCommand(args []string) error {
+	return syncFolder(commandFlags("revert", "<dir>",
+		"Synchronizes a receive-only folder, replacing its local changes with the version of the peer"), args, true)
+}
+
+// Folder id of a folder given on the command line
+const DEFAULT_FOLDER = "default"
+
+// Sync of a folder with a peer
+type SyncJob struct {
+	ID         string // names the channels of its session
+	Dir        string
+	PeerName   string // name the peer is pinned as
+	AES        string
+	Passphrase bool
+	Private    string
+	Revert     bool
+	Folder     *atf.FolderSettings // nil for a folder given on the command line
+	Progress   atf.ProgressFunc    // nil to not report the transfers
 
-	dir := flag.Arg(0)
-	log.Printf("Creating stats...")
-	excludeDB := atf.MakeIgnoreSuffix(DBNAME)
+	secret *atf.Secret
+	tagger *atf.Tagger // nil unless private: tags are then plain paths
+}
+
+// Connection to a peer, shared by the folders synced with it
+type PeerConn struct {
+	Mux      *atf.Mux
+	Offer    bool // this side offered the connection
+	Identity *atf.Identity
+	Peers    *atf.KnownPeers
+	Peer     ed25519.PublicKey // authenticated when connecting
+}
+
+// Syncs the folder given in args, or else every folder of the settings
+// with each of its peers
+func syncFolder(flags *flag.FlagSet, args []string, revert bool) error {
+	var settingsPath string
+	var debug bool
+	var aes string
+	var passphrase bool
+	var private string
+	var progress bool
 
-	policy := func(p string) bool {
-		return excludeDB(p) && p != dir
+	atf.SettingsFlag(flags, &settingsPath)
+	atf.DebugFlag(flags, &debug)
+	atf.AESFlag(flags, &aes)
+	atf.PassphraseFlag(flags, &passphrase)
+	atf.ProgressFlag(flags, &progress)
+	flags.StringVar(&private, "private", "",
+		"folder secret file: paths are only revealed to a peer holding it, for the entries it needs")
+	minArgs := 0
+	if revert {
+		minArgs = 1
 	}
+	positional := commandArgs(flags, args, minArgs, 1)
+	atf.SetDebugMode(debug)
 
-	file, err := os.Open(settingsPath)
+	settings, err := atf.LoadSettings(settingsPath)
 	if err != nil {
-		errorLog.Fatalf("Failed to read settings: %v", err)
+		return err
+	}
+	configDir := filepath.Dir(settingsPath)
+	var listener atf.ProgressFunc
+	if progress {
+		listener = atf.NewProgressDisplay(os.Stderr).Update
+	}
+	if len(positional) == 1 {
+		if settings.Key == "" {
+			return fmt.Errorf("no signaling key in %s: set Key to the one shared with the peer", settingsPath)
+		}
+		return SyncPeer(settings.ConnectionSettings, configDir, []*SyncJob{{
+			ID:         DEFAULT_FOLDER,
+			Dir:        positional[0],
+			PeerName:   settings.Key,
+			AES:        aes,
+			Passphrase: passphrase,
+			Private:    private,
+			Revert:     revert,
+			Progress:   listener,
+		}})
 	}
 
-	bytes, err := io.ReadAll(file)
+	if len(settings.Folders) == 0 {
+		return fmt.Errorf("no folders declared in %s: give the folder to sync", settingsPath)
+	}
+	// the folders shared with a peer are synced over one connection
+	byPeer := make(map[string][]*SyncJob)
+	for i := range settings.Folders {
+		folder := &settings.Folders[i]
+		for _, peer := range folder.Peers {
+			job := &SyncJob{
+				ID:         folder.ID,
+				Dir:        folder.Path,
+				PeerName:   peer,
+				AES:        aes,
+				Passphrase: passphrase,
+				Private:    private,
+				Folder:     folder,
+				Progress:   listener,
+			}
+			if folder.Key != "" {
+				job.AES = folder.Key
+			}
+			byPeer[peer] = append(byPeer[peer], job)
+		}
+	}
+	errs := make([]error, 0)
+	for _, peer := range slices.Sorted(maps.Keys(byPeer)) {
+		connection := settings.ConnectionSettings
+		connection.Key = peer
+		log.Printf("Syncing %d folders with %s", len(byPeer[peer]), peer)
+		if err := SyncPeer(connection, configDir, byPeer[peer]); err != nil {
+			errs = append(errs, fmt.Errorf("peer %s: %w", peer, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checks the folder and loads its keys. Runs before connecting, so that
+// passphrases are never asked for concurrently.
+func (job *SyncJob) Prepare() error {
+	if err := checkFolder(job.Dir); err != nil {
+		return err
+	}
+	var salt []byte
+	var err error
+	if job.Passphrase {
+		// salt is per folder, the peer's one is mixed in at handshake
+		salt, err = atf.LoadOrCreateSalt(GetSaltFile(job.Dir))
+		if err != nil {
+			return fmt.Errorf("cannot load folder salt: %w", err)
+		}
+	}
+	job.secret, err = atf.MakeSecret(job.AES, job.Passphrase, salt)
 	if err != nil {
-		errorLog.Fatalf("Failed to read file: %v", err)
+		return fmt.Errorf("cannot load encryption key: %w", err)
 	}
-	file.Close()
-	
-	var settings dc.ConnectionSettings
-	if err := json.Unmarshal(bytes, &settings); err != nil {
-		errorLog.Fatalf("Invalid settings: %v", err)
+	if job.Private != "" {
+		folderSecret, err := atf.LoadFolderSecret(job.Private)
+		if err != nil {
+			return fmt.Errorf("cannot load folder secret: %w", err)
+		}
+		if job.tagger, err = atf.NewTagger(folderSecret); err != nil {
+			return fmt.Errorf("cannot load folder secret: %w", err)
+		}
 	}
-	log.Printf("Opening connection...")
-	conn, err := dc.FromSettings(&settings)
+	return nil
+}
+
+// Tracks a transfer of the folder, nil if it is not reported
+func (job *SyncJob) progress(direction string) *atf.Progress {
+	if job.Progress == nil {
+		return nil
+	}
+	name := filepath.Base(job.Dir)
+	if job.Folder != nil {
+		name = job.ID + "@" + job.PeerName
+	}
+	return atf.NewProgress(name+": "+direction, job.Progress)
+}
+
+// Syncs the folders of jobs with the peer met on connection.Key, over
+// one connection: each folder runs concurrently in its own session, on
+// the channels of a Mux named after it. A failure in a folder does not
+// stop the others.
+func SyncPeer(connection dc.ConnectionSettings, configDir string, jobs []*SyncJob) error {
+	errs := make([]error, len(jobs))
+	ready := make([]*SyncJob, 0, len(jobs))
+	for i, job := range jobs {
+		if err := job.Prepare(); err != nil {
+			errs[i] = fmt.Errorf("folder %s: %w", job.ID, err)
+		} else {
+			ready = append(ready, job)
+		}
+	}
+	if len(ready) == 0 {
+		return errors.Join(errs...)
+	}
+
+	identity, knownPeers, err := atf.LoadDevice(configDir)
 	if err != nil {
-		errorLog.Fatalf("Failed to open connection: %v", err)
+		return fmt.Errorf("cannot load device identity: %w", err)
 	}
+	log.Printf("Device fingerprint: %s", identity.Fingerprint())
 
+	log.Printf("Opening connection...")
+	conn, err := dc.FromSettings(&connection)
+	if err != nil {
+		return fmt.Errorf("failed to open connection: %w", err)
+	}
 	defer conn.CloseAll()
+	over := atf.WatchState(conn)
+	peer := &PeerConn{
+		Mux:      atf.NewMux(conn),
+		Offer:    conn.Offer,
+		Identity: identity,
+		Peers:    knownPeers,
+	}
 
-	go StateLog(conn)
+	// the device is authenticated once for the connection, before it
+	// learns anything about the folders. The session of the connection
+	// ends on its channel too, once every folder is synced.
+	control := peer.Mux.Open("")
+	defer atf.EndSession(control, over)
+	session, err := atf.Handshake(control, &atf.HandshakeConfig{
+		Identity: identity,
+		Peers:    knownPeers,
+		PeerName: connection.Key,
+	})
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	peer.Peer = session.Peer
+	log.Printf("Authenticated peer %s", atf.Fingerprint(session.Peer))
 
-	statsFileName := GetStatsDB(dir)
-	oldStats, err := LoadStats(dir)
+	// only the folders synced by both sides are synced
+	ids := make([]string, len(ready))
+	for i, job := range ready {
+		ids[i] = job.ID
+	}
+	// a message failing to decrypt aborts the exchange: the channel is
+	// closed, so that it fails on both sides
+	errChannel := make(chan error, 1)
+	failure := make(chan struct{})
+	var failErr error
+	go func() {
+		if failErr = <-errChannel; failErr != nil {
+			control.Close()
+		}
+		close(failure)
+	}()
+	shared, err := ExchangePaths(atf.Secure(control, session.Cypher, errChannel), ids)
+	errChannel <- nil
+	<-failure
+	if failErr != nil {
+		err = failErr
+	}
 	if err != nil {
-		if os.IsNotExist(err) { // new DB: empty stats
-			log.Println("Creating new folder database")
-			if err := os.WriteFile(statsFileName, []byte{}, 0644); err != nil {
-				errorLog.Fatalf("Failed creating stats file: %v", err)
+		return fmt.Errorf("cannot exchange the folders to sync: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		switch {
+		case errs[i] != nil:
+			continue
+		case !slices.Contains(shared, job.ID):
+			errs[i] = fmt.Errorf("folder %s: not shared by the peer", job.ID)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := SyncFolder(job, peer); err != nil {
+				errs[i] = fmt.Errorf("folder %s: %w", job.ID, err)
 			}
-		} else {
-			errorLog.Fatalf("Cannot load new stats: %v", err)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Takes the entries outside the selective sync of config out of the
+// stats of the last sync and of the scan: they are only known from the
+// peer, and returned as remoteOnly. The ones scanned and unchanged since
+// the last sync are deselected, to be removed once the peer holds them;
+// changed ones are left alone. The remote-only entries selected again
+// are wanted from the peer.
+func SplitSelection(config *atf.FolderConfig, oldStats, newStats atf.Stats) (remoteOnly atf.Stats, deselected, wanted []string) {
+	remoteOnly = make(atf.Stats)
+	for p, info := range oldStats {
+		if info.Remote {
+			remoteOnly[p] = info
+			delete(oldStats, p)
+		}
+	}
+	deselected = make([]string, 0)
+	for p, info := range newStats {
+		if config.Selected(p) {
+			continue
+		}
+		delete(newStats, p)
+		old, synced := oldStats[p]
+		delete(oldStats, p)
+		if !info.IsDir && (!synced || !old.Same(info)) {
+			warnLog.Printf("%s is outside the selective sync and was changed: keeping it unsynced", p)
+			continue
+		}
+		info.Remote = true
+		remoteOnly[p] = info
+		deselected = append(deselected, p)
+	}
+	wanted = make([]string, 0)
+	for p := range remoteOnly {
+		if config.Selected(p) {
+			wanted = append(wanted, p)
 		}
 	}
+	return remoteOnly, deselected, wanted
+}
 
-	newStats, err := atf.CreateStats(dir, policy)
+// Exchanges the entries wanted by each side, returning the paths of
+// stats the peer wants. anyWanted tells whether either side wants
+// anything, held or not: both peers agree on it, and only skip the
+// transfers if neither wants anything.
+func ExchangeWanted(c dc.IOChannel, tagger *atf.Tagger, stats atf.Stats, wanted []string) (peerWanted []string, anyWanted bool, err error) {
+	tags, err := ExchangePaths(c, tagger.Paths(wanted))
 	if err != nil {
-		errorLog.Fatalf("Cannot create new stats: %v", err)
+		return nil, false, err
 	}
+	return WantedPaths(tagger, stats, tags), len(wanted) > 0 || len(tags) > 0, nil
+}
+
+// Returns the paths of stats among the tags the peer wants: tags of
+// entries not held locally are dropped
+func WantedPaths(tagger *atf.Tagger, stats atf.Stats, tags []string) []string {
+	if len(tags) == 0 {
+		return tags
+	}
+	names := make(map[string]string, len(stats))
+	for p := range stats {
+		names[tagger.Path(p)] = p
+	}
+	paths := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if p, ok := names[tag]; ok {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Syncs a folder with a peer, on the channels named after it
+func SyncFolder(job *SyncJob, peer *PeerConn) (err error) {
+	// opened first, so that the peer is not left waiting on them: closing
+	// the channels makes its session end too
+	control := peer.Mux.Open(job.ID)
+	files := []*atf.MuxChannel{peer.Mux.Open(job.ID + "/0"), peer.Mux.Open(job.ID + "/1")}
+	defer func() {
+		for _, c := range append(files, control) {
+			c.Close()
+		}
+	}()
+
+	dir := job.Dir
+	log.Printf("%s: creating stats...", job.ID)
+	ignore, err := atf.LoadIgnoreRules(dir)
+	if err != nil {
+		return fmt.Errorf("cannot read %s files: %w", atf.IgnoreFile, err)
+	}
+
+	config, err := atf.LoadFolderConfig(GetConfigFile(dir))
+	if err != nil {
+		return err
+	}
+	// the settings of the device take precedence
+	if job.Folder != nil {
+		job.Folder.AddIgnored(ignore)
+		job.Folder.Apply(config)
+	}
+	if job.Revert && config.Mode != atf.ReceiveOnly {
+		return fmt.Errorf("only local changes of %s folders can be reverted", atf.ReceiveOnly)
+	}
+
+	// deleted files are kept there
+	trash, err := atf.OpenTrash(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open the trash: %w", err)
+	}
+	// files replaced by the ones of the peer are kept there
+	versions, err := atf.OpenVersions(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open the file versions: %w", err)
+	}
+	syncLog, err := atf.OpenSyncLog(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open the sync log: %w", err)
+	}
+
+	policy := FolderPolicy(ignore)
+
+	tagger := job.tagger
+
+	session, err := atf.Handshake(control, &atf.HandshakeConfig{
+		Secret:   job.secret,
+		Identity: peer.Identity,
+		Peers:    peer.Peers,
+		PeerName: job.PeerName,
+	})
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	// the folder secret is checked by a handshake of its own, which must
+	// come from the device of the connection
+	if !session.Peer.Equal(peer.Peer) {
+		return fmt.Errorf("%w: folder session from another device", atf.ErrAuthFailed)
+	}
+	peerID := atf.Fingerprint(session.Peer)
+	log.Printf("%s: authenticated peer %s", job.ID, peerID)
+	event := atf.SyncEvent{Time: time.Now().UTC(), Peer: peerID}
+	cypher := session.Cypher
+
+	// the first error aborts the session: its channels are closed, so
+	// that every pending exchange fails, on both sides. A nil error
+	// marks the end of the session.
+	errChannel := make(chan error, 1)
+	failure := make(chan struct{})
+	var failErr error
+	go func() {
+		failErr = <-errChannel
+		close(failure)
+		for _, c := range append(files, control) {
+			c.Close()
+		}
+		for range errChannel {
+		}
+	}()
+	defer func() {
+		select {
+		case <-failure:
+			if failErr != nil {
+				err = failErr
+			}
+		default:
+		}
+	}()
+	// waits for the errors reported so far, ending the session
+	settle := func() error {
+		errChannel <- nil
+		<-failure
+		return failErr
+	}
+	channel := atf.Secure(control, cypher, errChannel)
+
+	oldStats, err := LoadStats(dir)
+	if err != nil {
+		return fmt.Errorf("cannot load the folder database: %w", err)
+	}
+
+	// only files whose metadata changed since the last run are read, and
+	// the scan is compared with the database as it goes
+	cache := atf.LoadScanCache(GetCacheFile(dir))
+	newStats := make(atf.Stats)
+	var scanErr error
+	scan := atf.TeeStats(cache.Seq(os.DirFS(dir), ".", policy, 0, &scanErr), newStats)
+	added, deleted, modified := LocalChanges(oldStats, scan, ignore)
+	if scanErr != nil {
+		return fmt.Errorf("cannot create new stats: %w", scanErr)
+	}
+
+	// the entries outside the selective sync are not local changes
+	remoteOnly, deselected, wanted := SplitSelection(config, oldStats, newStats)
+	unselected := func(p string) bool { return !config.Selected(p) }
+	added = slices.DeleteFunc(added, unselected)
+	modified = slices.DeleteFunc(modified, unselected)
 	
-	added := atf.RemovePrefix(dir, atf.StatsKeyDiff(newStats, oldStats))
-	deleted := atf.RemovePrefix(dir, atf.StatsKeyDiff(oldStats, newStats))
-	modified := atf.RemovePrefix(dir, atf.StatsValueDiff(newStats, oldStats))
-	
+	for _, paths := range [][]string{added, deleted, modified} {
+		for _, p := range paths {
+			versions.SetOrigin(p, "")
+		}
+	}
+
+	changes := &FolderChanges{Added: added, Deleted: deleted, Modified: modified, Wanted: wanted}
+	if err := ApplyMode(dir, config.Mode, job.Revert, trash, oldStats, newStats, changes); err != nil {
+		return err
+	}
+	added, deleted, modified, wanted = changes.Added, changes.Deleted, changes.Modified, changes.Wanted
+	reverted := changes.Reverted
+
+	if err := atf.CheckTagger(channel, tagger); err != nil {
+		return err
+	}
+	// newly selected entries are asked for even if unchanged on the peer
+	peerWanted, anyWanted, err := ExchangeWanted(channel, tagger, newStats, wanted)
+	if err != nil {
+		return fmt.Errorf("invalid selection from peer: %w", err)
+	}
+
+	// deselected entries are not deletions, but they are only removed
+	// once the peer confirms it holds them
+	local := tagger.Stats(newStats)
+	holding := make(map[string]bool, len(local))
+	for tag := range local {
+		holding[tag] = true
+	}
+	held, err := FetchStats(channel, local, holding, tagger.Paths(deselected))
+	if err != nil {
+		return fmt.Errorf("cannot confirm deselected entries: %w", err)
+	}
+	deselected = slices.DeleteFunc(deselected, func(p string) bool {
+		if _, ok := held[tagger.Path(p)]; ok {
+			return false
+		}
+		log.Printf("Keeping %s: the peer does not hold it", p)
+		// still synced, until the peer holds it
+		info := remoteOnly[p]
+		info.Remote = false
+		newStats[p] = info
+		delete(remoteOnly, p)
+		return true
+	})
+	removeLocal(dir, deselected, trash)
+
+	// in private mode the peer only sees tags until paths are revealed
+	known := maps.Clone(newStats)
+	maps.Copy(known, remoteOnly)
+	view := tagger.Stats(known)
+
+	// identical subtrees need no exchange: only changes where the
+	// folders differ are announced. Tags have no subtrees, so in private
+	// mode the whole view is exchanged as soon as the folders differ.
+	diff, err := atf.CompareMerkle(channel, atf.BuildMerkle(view))
+	if err != nil {
+		return fmt.Errorf("cannot compare folders: %w", err)
+	}
+	if diff.Equal() && !anyWanted {
+		log.Printf("%s: folders are identical", job.ID)
+		if err := settle(); err != nil {
+			return err
+		}
+		if err := SaveStats(dir, known, cache); err != nil {
+			return err
+		}
+		SaveArchives(trash, versions, config)
+		LogSync(syncLog, event)
+		log.Printf("%s: closing", job.ID)
+		return nil
+	}
+	same := func(p string) bool { return !diff.Differs(tagger.Path(p)) }
+	added = slices.DeleteFunc(added, same)
+	deleted = slices.DeleteFunc(deleted, same)
+	modified = slices.DeleteFunc(modified, same)
+
 	updater := make(chan []string, 3)
-	go SendUpdates(conn, added, deleted, modified)
-	go RecvUpdates(conn, updater)
-	remoteAdded := <- updater
-	remoteDeleted := <- updater
-	remoteModified := <- updater
-	<- SendLock
+	sent := make(chan bool, 1)
+	go SendUpdates(channel, tagger.Paths(added), tagger.Paths(deleted), tagger.Paths(modified), sent)
+	go RecvUpdates(channel, updater, errChannel)
+	updates := make([][]string, 0, 3)
+	for len(updates) < 3 {
+		select {
+		case paths := <-updater:
+			updates = append(updates, paths)
+		case <-failure:
+			return failErr
+		}
+	}
+	remoteAdded, remoteDeleted, remoteModified := updates[0], updates[1], updates[2]
+	select {
+	case <-sent:
+	case <-failure:
+		return failErr
+	}
 	
 	log.Printf("sent: %#v %#v %#v\n", added, deleted, modified)
 	log.Printf("received: %#v %#v %#v\n", remoteAdded, remoteDeleted, remoteModified)
 	
 	changed := append(added, modified...)
 	remoteChanged := append(remoteAdded, remoteModified...)
-	toRequest, err := LatestModSolver(conn, newStats, changed, remoteChanged)
+	// the peer may only ask for what we announced
+	serveable := ServeSet(dir, append(slices.Clone(changed), peerWanted...), policy)
+	removable := SafeSet(dir, deleted)
+	// modification times are only sent for conflicting entries
+	times := tagger.ModTimes(known)
+	toRequest, err := LatestModSolver(channel, times, TagSet(tagger, serveable), tagger.Paths(changed), remoteChanged)
+	if err != nil {
+		return fmt.Errorf("error while resolving + conflicts: %w", err)
+	}
+
+	// only conflict possible: modified locally deleted remotely
+	toDelete, err := LatestModSolver(channel, times, TagSet(tagger, removable), tagger.Paths(modified), remoteDeleted)
 	if err != nil {
-		errorLog.Fatalf("Error while resolving + conflicts: %v", err)
+		return fmt.Errorf("error while resolving - conflicts: %w", err)
+	}
+
+	revealable := make(map[string]string, len(serveable)+len(removable))
+	for _, set := range []map[string]bool{serveable, removable} {
+		for p := range set {
+			revealable[tagger.Path(p)] = p
+		}
+	}
+	if toRequest, err = atf.RevealPaths(channel, tagger, revealable, toRequest); err != nil {
+		return fmt.Errorf("cannot reveal paths: %w", err)
+	}
+	if toDelete, err = atf.RevealPaths(channel, tagger, revealable, toDelete); err != nil {
+		return fmt.Errorf("cannot reveal paths: %w", err)
+	}
+	// outside the selective sync only the metadata is fetched
+	outside := make([]string, 0)
+	toRequest = slices.DeleteFunc(toRequest, func(p string) bool {
+		if config.Selected(p) {
+			return false
+		}
+		outside = append(outside, p)
+		return true
+	})
+	fetched, err := FetchStats(channel, newStats, serveable, outside)
+	if err != nil {
+		return fmt.Errorf("cannot fetch remote-only stats: %w", err)
+	}
+	for p, info := range fetched {
+		info.Remote = true
+		remoteOnly[p] = info
+	}
+	toDelete = slices.DeleteFunc(toDelete, func(p string) bool {
+		_, ok := remoteOnly[p]
+		delete(remoteOnly, p)
+		return ok
+	})
+	for _, p := range wanted {
+		_, remote := remoteOnly[p]
+		if (remote || reverted[p]) && !slices.Contains(toRequest, p) && !slices.Contains(toDelete, p) {
+			toRequest = append(toRequest, p)
+		}
 	}
 
-	toDelete, err := LatestModSolver(conn, newStats, modified, remoteDeleted) // only conflict possible: modified locally deleted remotely
+	if config.Mode == atf.SendOnly {
+		log.Printf("Send-only folder: ignoring %d remote changes", len(toRequest)+len(toDelete))
+		toRequest, toDelete = toRequest[:0], toDelete[:0]
+	}
+
+	// ignored paths are never written
+	toRequest = DropIgnored(ignore, toRequest)
+	toDelete = DropIgnored(ignore, toDelete)
 	log.Printf("To download: %#v", toRequest)
 	log.Printf("To delete: %#v", toDelete)
+
+	// both sides changed these: the latest modification was kept
+	event.Sent = len(added) + len(deleted) + len(modified)
+	event.Received, event.Deleted = len(toRequest), len(toDelete)
+	event.Conflicts = append(
+		FindConflicts(tagger, newStats, changed, remoteChanged, toRequest, false),
+		FindConflicts(tagger, newStats, modified, remoteDeleted, toDelete, true)...,
+	)
+	for i, c := range event.Conflicts {
+		log.Printf("Conflict on %s: %s version kept", c.Path, c.Winner)
+		if config.Conflicts != atf.KeepBoth || c.Winner != atf.RemoteSide {
+			continue
+		}
+		if event.Conflicts[i].Copy, err = KeepConflictCopy(dir, c.Path, event.Time); err != nil {
+			return fmt.Errorf("cannot keep a copy of %s: %w", c.Path, err)
+		}
+	}
 	
-	if err := deleteFiles(dir, toDelete); err != nil {
-		log.Fatalf("Error while deleting files: %v", err)
+	if err := deleteFiles(dir, toDelete, trash); err != nil {
+		return fmt.Errorf("error while deleting files: %w", err)
+	}
+	for _, p := range toDelete {
+		versions.SetOrigin(p, "")
 	}
 	
-	closeChannel := make(chan bool, 1)
-	proxy1, proxy2 := dc.DualDispatch(conn, closeChannel)	
-	errChannel := make(chan error, 1)
+	proxy1 := atf.Secure(files[0], cypher, errChannel)
+	proxy2 := atf.Secure(files[1], cypher, errChannel)
 
+	receiving, sending := job.progress("receiving"), job.progress("sending")
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	if conn.Offer {
-		go SendFiles(proxy1, newStats, dir, &wg, errChannel)
-		go DownloadFiles(proxy2, newStats, dir, toRequest, &wg, errChannel)
+	if peer.Offer {
+		go SendFiles(proxy1, newStats, serveable, dir, sending, &wg, errChannel)
+		go DownloadFiles(proxy2, newStats, dir, toRequest, ignore, versions, peerID, receiving, &wg, errChannel)
 	} else {
-		go DownloadFiles(proxy1, newStats, dir, toRequest, &wg, errChannel)
-		go SendFiles(proxy2, newStats, dir, &wg, errChannel)
+		go DownloadFiles(proxy1, newStats, dir, toRequest, ignore, versions, peerID, receiving, &wg, errChannel)
+		go SendFiles(proxy2, newStats, serveable, dir, sending, &wg, errChannel)
 	}
+
+	transferred := make(chan struct{})
 	go func() {
-		err := <- errChannel
-		errorLog.Fatalf("Error: %v", err)
+		wg.Wait()
+		close(transferred)
 	}()
-
-	wg.Wait()
-	closeChannel <- true
+	select {
+	case <-transferred:
+	case <-failure:
+		return failErr
+	}
+	if err := settle(); err != nil {
+		return err
+	}
 	
-	statsBytes, err := json.Marshal(newStats)
+	for p, info := range remoteOnly {
+		if _, ok := newStats[p]; !ok {
+			newStats[p] = info
+		}
+	}
+	if err := SaveStats(dir, newStats, cache); err != nil {
+		return err
+	}
+	// the local versions replaced in conflicts are restored exactly
+	for i, c := range event.Conflicts {
+		if c.Winner != atf.RemoteSide || c.Deleted {
+			continue
+		}
+		if history := versions.History(c.Path); len(history) > 0 && !history[0].Archived.Before(event.Time) {
+			event.Conflicts[i].Version = history[0].File
+		}
+	}
+	SaveArchives(trash, versions, config)
+	LogSync(syncLog, event)
+	
+	log.Printf("%s: closing", job.ID)
+	return nil
+}
+
+// Copies the local version of p next to it, as a conflict copy sent
+// to the peer by the next sync. Returns the name of the copy.
+func KeepConflictCopy(dir, p string, now time.Time) (string, error) {
+	name := atf.ConflictCopyName(p, now.Local())
+	src, err := atf.SafeJoin(dir, p)
 	if err != nil {
-		log.Fatalf("Error: cannot serialize new stats: %v", err)
+		return "", err
 	}
+	dst, err := atf.SafeJoin(dir, name)
+	if err != nil {
+		return "", err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return name, nil
+}
 
-	if err := os.WriteFile(statsFileName, statsBytes, 0644); err != nil {
-		errorLog.Fatalf("Failed writing stats file: %v", err)
+// Records a completed sync in the log of the folder
+func LogSync(syncLog *atf.SyncLog, event atf.SyncEvent) {
+	syncLog.Add(event)
+	if err := syncLog.Save(); err != nil {
+		warnLog.Printf("Cannot update the sync log: %v", err)
 	}
-	
-	log.Printf("Closing")
+}
+
+// Applies the retention of the folder to its trash and versions, and
+// saves them
+func SaveArchives(trash *atf.Trash, versions *atf.Versions, config *atf.FolderConfig) {
+	pruned, err := trash.Prune(config.Trash)
+	for _, e := range pruned {
+		log.Printf("Deleted %s from the trash", e.Path)
+	}
+	if err == nil {
+		err = trash.Save()
+	}
+	if err != nil {
+		warnLog.Printf("Cannot update the trash: %v", err)
+	}
+
+	days := config.VersionsDays
+	if days == 0 {
+		days = atf.DefaultVersionsDays
+	}
+	thinned, err := versions.Thin(time.Duration(days)*24*time.Hour, time.Now())
+	for _, v := range thinned {
+		log.Printf("Deleted a version of %s from %s", v.Path, v.Archived.Local().Format(time.DateTime))
+	}
+	if err == nil {
+		err = versions.Save()
+	}
+	if err != nil {
+		warnLog.Printf("Cannot update the file versions: %v", err)
+	}
+}
+
+// Selects the paths of dir that are synced
+func FolderPolicy(ignore *atf.IgnoreRules) atf.Policy {
+	return atf.And(
+		atf.ExcludeSuffix(DBNAME),
+		atf.ExcludeSuffix(atf.PartialSuffix),
+		atf.ExcludeSuffix(SALTNAME),
+		atf.ExcludeSuffix(CACHENAME),
+		atf.ExcludeSuffix(CONFIGNAME),
+		atf.ExcludeMeta,
+		ignore.Policy(),
+	)
+}
+
+// Returns the conflicts between the local changes and the remote ones,
+// given as tags. The remote side won the paths in taken.
+func FindConflicts(tagger *atf.Tagger, stats atf.Stats, local, remote, taken []string, deleted bool) []atf.Conflict {
+	remoteSet := make(map[string]bool, len(remote))
+	for _, tag := range remote {
+		remoteSet[tag] = true
+	}
+	conflicts := make([]atf.Conflict, 0)
+	for _, p := range local {
+		// directories change with their content
+		if stats[p].IsDir || !remoteSet[tagger.Path(p)] {
+			continue
+		}
+		winner := atf.LocalSide
+		if slices.Contains(taken, p) {
+			winner = atf.RemoteSide
+		}
+		conflicts = append(conflicts, atf.Conflict{Path: p, Winner: winner, Deleted: deleted})
+	}
+	return conflicts
+}
+
+// Returns the paths added, deleted and modified since the last sync,
+// in ComparePaths order. The scan, in the same order, is read once side
+// by side with the database; entries only known from the peer are not
+// local ones.
+func LocalChanges(oldStats atf.Stats, scan iter.Seq2[string, atf.FileInfo], ignore *atf.IgnoreRules) (added, deleted, modified []string) {
+	synced := func(yield func(string, atf.FileInfo) bool) {
+		for p, info := range atf.SortedStats(oldStats) {
+			if !info.Remote && !yield(p, info) {
+				return
+			}
+		}
+	}
+	// keys are relative to dir, however it was spelled
+	added, deleted, modified = make([]string, 0), make([]string, 0), make([]string, 0)
+	for p, change := range atf.DiffSeq(synced, scan) {
+		switch change.Kind {
+		case atf.Added:
+			added = append(added, p)
+		case atf.Deleted:
+			// newly ignored paths are still there, they are just no longer synced
+			if !ignore.Ignored(p, change.Old.IsDir) {
+				deleted = append(deleted, p)
+			}
+		case atf.Modified:
+			modified = append(modified, p)
+		}
+	}
+	return added, deleted, modified
+}
+
+// Writes the stats of the completed sync to the folder database
+func SaveStats(dir string, stats atf.Stats, cache *atf.ScanCache) error {
+	statsBytes, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("cannot serialize new stats: %w", err)
+	}
+
+	if err := os.WriteFile(GetStatsDB(dir), statsBytes, 0644); err != nil {
+		return fmt.Errorf("failed writing stats file: %w", err)
+	}
+	if err := cache.Save(); err != nil {
+		warnLog.Printf("Cannot save the scan cache: %v", err)
+	}
+	return nil
 }
 
 func GetStatsDB(dir string) string {
 	return atf.PathJoin([]string{dir, DBNAME})
 }
 
+func GetSaltFile(dir string) string {
+	return atf.PathJoin([]string{dir, SALTNAME})
+}
+
+func GetCacheFile(dir string) string {
+	return atf.PathJoin([]string{dir, CACHENAME})
+}
+
+func GetConfigFile(dir string) string {
+	return atf.PathJoin([]string{dir, CONFIGNAME})
+}
+
 func LoadStats(dir string) (atf.Stats, error) {
 	statsPath := GetStatsDB(dir)
 	file, err := os.Open(statsPath)
@@ -175,92 +979,291 @@ func LoadStats(dir string) (atf.Stats, error) {
 	return atf.StatsFromJSON(bytes)
 }
 
-func PathsToByte(paths []string) []byte {
-	return []byte(strings.Join(paths, ";"))
+func SendUpdates(conn dc.IOChannel, added, deleted, modified []string, sent chan bool) {
+	for _, paths := range [][]string{added, deleted, modified} {
+		atf.SendPaths(conn, paths)
+	}
+	sent <- true
+}
+
+func RecvUpdates(conn dc.IOChannel, updater chan []string, errChannel chan error) {
+	for range 3 {
+		paths, err := atf.RecvPaths(conn)
+		if err != nil {
+			errChannel <- fmt.Errorf("invalid change list from peer: %w", err)
+			return
+		}
+		updater <- paths
+	}
 }
 
-func PathsFromByte(b []byte) []string {
-	if len(b)==0 {
-		return []string{}
+// Returns the subset of paths whose name is safe
+func SafeSet(dir string, paths []string) map[string]bool {
+	safe := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if _, err := atf.SafeJoin(dir, p); err == nil {
+			safe[p] = true
+		}
 	}
-	return strings.Split(string(b), ";")
+	return safe
 }
 
-func SendUpdates(conn *dc.Connection, added, deleted, modified []string) {
-	addedBin := PathsToByte(added)	
-	deletedBin := PathsToByte(deleted)	
-	modifiedBin := PathsToByte(modified)	
-  conn.In <- addedBin
-	conn.In <- deletedBin 
-	conn.In <- modifiedBin
-	SendLock <- true
+// Returns the subset of paths that can be served to the peer:
+// the ones whose name is safe and that exist and pass policy.
+func ServeSet(dir string, paths []string, policy atf.Policy) map[string]bool {
+	allowed := SafeSet(dir, paths)
+	for p := range allowed {
+		info, err := os.Lstat(filepath.Join(dir, p))
+		if err != nil || policy(p, fs.FileInfoToDirEntry(info)) != atf.Include {
+			delete(allowed, p)
+		}
+	}
+	return allowed
 }
 
-func RecvUpdates(conn *dc.Connection, updater chan []string) {
-	addedBin := <- conn.Out
-	deletedBin := <- conn.Out
-	modifiedBin := <- conn.Out
-	updater <- PathsFromByte(addedBin)
-	updater <- PathsFromByte(deletedBin)
-	updater <- PathsFromByte(modifiedBin)
+// Returns the tags of the paths in set
+func TagSet(tagger *atf.Tagger, set map[string]bool) map[string]bool {
+	tags := make(map[string]bool, len(set))
+	for p := range set {
+		tags[tagger.Path(p)] = true
+	}
+	return tags
 }
 
+// Resolves conflicts between local and remote changes by modification time.
+// The peer's metadata requests are answered only for paths in allowed.
 func LatestModSolver(
-	conn *dc.Connection,
+	conn dc.IOChannel,
 	db atf.Stats,
+	allowed map[string]bool,
 	local, remote []string,
 ) ([]string, error) {
 	toPull := make([]string, 0)
 	toRequest := make([]string, 0)
+	isLocal := make(map[string]bool, len(local))
+	for _, l := range local {
+		isLocal[l] = true
+	}
 	for _,r := range remote {
-		if slices.Contains(local, r) {
+		if isLocal[r] {
 			toRequest = append(toRequest, r)
 		} else {
 			toPull = append(toPull, r)
 		}
 	}
 
-	conn.In <- PathsToByte(toRequest)
-	toSend := PathsFromByte(<-conn.Out)
+	remoteDB, err := FetchStats(conn, db, allowed, toRequest)
+	if err != nil {
+		return toPull, err
+	}
+	for k,v := range remoteDB {
+		if v.ModTime.UnixNano() > db[k].ModTime.UnixNano() {
+			toPull = append(toPull, k)
+		}
+	}
+	return toPull, nil
+}
+
+// Sends paths to the peer while receiving its ones
+func ExchangePaths(conn dc.IOChannel, paths []string) ([]string, error) {
+	// both sides send before receiving: batches go out concurrently
+	sent := make(chan error, 1)
+	go func() {
+		sent <- atf.SendPaths(conn, paths)
+	}()
+	received, err := atf.RecvPaths(conn)
+	if sendErr := <-sent; err == nil {
+		err = sendErr
+	}
+	return received, err
+}
+
+// Asks the peer for the metadata of wanted while answering its requests
+// for the paths in allowed. Returns the metadata received.
+func FetchStats(conn dc.IOChannel, db atf.Stats, allowed map[string]bool, wanted []string) (atf.Stats, error) {
+	toSend, err := ExchangePaths(conn, wanted)
+	if err != nil {
+		return nil, err
+	}
 
 	lock := make(chan bool, 1)
 
 	go func() {
 		subDB := make(atf.Stats)
 		for _,k := range toSend {
+			if !allowed[k] {
+				warnLog.Printf("SOLVER: refusing metadata of unauthorized path %q", k)
+				continue
+			}
 			subDB[k] = db[k]
 		}
-		payload, _ := atf.StatsToJSON(subDB)
-		conn.In <- payload
+		atf.SendStats(conn, atf.SortedStats(subDB))
 		lock <- true
 	}()
 
-	remoteDB, err := atf.StatsFromJSON(<- conn.Out)
+	remoteDB, err := atf.RecvStats(conn)
+	<- lock
 	if err != nil {
-		return toPull, err
+		return nil, err
 	}
-	for k,v := range remoteDB {
-		if v.ModTime.UnixNano() > db[k].ModTime.UnixNano() {
-			toPull = append(toPull, k)
+	isWanted := make(map[string]bool, len(wanted))
+	for _, w := range wanted {
+		isWanted[w] = true
+	}
+	for k := range remoteDB {
+		if !isWanted[k] {
+			delete(remoteDB, k)
 		}
 	}
-	<- lock
-	return toPull, nil
+	return remoteDB, nil
 }
 
-func deleteFiles(dir string, files []string) error {
-	for _, f := range files {
-		if err := os.Remove(filepath.Join(dir,f)); err != nil {
-			return err
+// Changes of a folder to sync with a peer
+type FolderChanges struct {
+	Added, Deleted, Modified []string
+	Wanted                   []string        // asked for even if unchanged on the peer
+	Reverted                 map[string]bool // local changes undone with the version of the peer
+}
+
+// Applies the mode of a folder to its changes. A receive-only folder
+// sends none: they are reported, and the database keeps the synced
+// state, so that they are reported until reverted. With revert, added
+// entries go to the trash and the others are wanted back from the peer.
+// A send-only folder wants nothing.
+func ApplyMode(
+	dir string,
+	mode atf.FolderMode,
+	revert bool,
+	trash *atf.Trash,
+	oldStats, newStats atf.Stats,
+	changes *FolderChanges,
+) error {
+	changes.Reverted = make(map[string]bool)
+	switch mode {
+	case atf.ReceiveOnly:
+		// directories change with their content, they are not local changes
+		changes.Modified = slices.DeleteFunc(changes.Modified, func(p string) bool { return newStats[p].IsDir })
+		undone := append(slices.Clone(changes.Deleted), changes.Modified...)
+		ReportLocalChanges(dir, revert, changes.Added, changes.Deleted, changes.Modified)
+		if revert {
+			if err := deleteFiles(dir, changes.Added, trash); err != nil {
+				return fmt.Errorf("cannot revert added files: %w", err)
+			}
+			for _, p := range undone {
+				changes.Reverted[p] = true
+				changes.Wanted = append(changes.Wanted, p)
+			}
+		}
+		for _, p := range changes.Added {
+			delete(newStats, p)
 		}
+		for _, p := range undone {
+			newStats[p] = oldStats[p]
+		}
+		changes.Added, changes.Deleted, changes.Modified = changes.Added[:0], changes.Deleted[:0], changes.Modified[:0]
+	case atf.SendOnly:
+		changes.Wanted = changes.Wanted[:0]
 	}
 	return nil
 }
 
-func StateLog(conn *dc.Connection) {
-	for {
-		log.Printf("conn state changed: %v", <-conn.State)
-	} 
+// Warns about the local changes of a receive-only folder, which are not sent
+func ReportLocalChanges(dir string, revert bool, added, deleted, modified []string) {
+	count := len(added) + len(deleted) + len(modified)
+	if count == 0 {
+		return
+	}
+	if revert {
+		log.Printf("Reverting %d local changes", count)
+	} else {
+		warnLog.Printf("Receive-only folder: %d local changes are not sent, run '%s revert %s' to undo them",
+			count, os.Args[0], dir)
+	}
+	for _, change := range []struct {
+		kind  string
+		paths []string
+	}{{"added", added}, {"deleted", deleted}, {"modified", modified}} {
+		for _, p := range change.paths {
+			warnLog.Printf("  %s %s", change.kind, p)
+		}
+	}
+}
+
+// Removes paths from disk, children first: files go to the trash,
+// directories still holding other entries are kept.
+func removeLocal(dir string, paths []string, trash *atf.Trash) {
+	sorted := slices.Clone(paths)
+	slices.SortFunc(sorted, func(a, b string) int { return atf.ComparePaths(b, a) })
+	for _, p := range sorted {
+		path, err := atf.SafeJoin(dir, p)
+		if err != nil {
+			continue
+		}
+		info, err := os.Lstat(path)
+		switch {
+		case err != nil:
+		case info.IsDir():
+			err = os.Remove(path)
+		default:
+			err = trash.Move(p, "deselected")
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Keeping %s: %v", p, err)
+		}
+	}
+	if err := trash.Save(); err != nil {
+		warnLog.Printf("Cannot update the trash: %v", err)
+	}
+}
+
+// Removes the paths ignored both as files and as directories.
+// Paths ignored only as one of them are checked again on download,
+// once their type is known.
+func DropIgnored(ignore *atf.IgnoreRules, paths []string) []string {
+	return slices.DeleteFunc(paths, func(p string) bool {
+		if ignore.Ignored(p, false) && ignore.Ignored(p, true) {
+			log.Printf("Skipping ignored path %s", p)
+			return true
+		}
+		return false
+	})
+}
+
+// Moves files to the trash, and removes the directories among them
+// once emptied. The trash index is written right away, even if a file
+// cannot be moved, so that the trashed files are never left out of it.
+func deleteFiles(dir string, files []string, trash *atf.Trash) (err error) {
+	defer func() {
+		if saveErr := trash.Save(); err == nil && saveErr != nil {
+			err = fmt.Errorf("cannot update the trash: %w", saveErr)
+		}
+	}()
+	sorted := slices.Clone(files)
+	slices.SortFunc(sorted, func(a, b string) int { return atf.ComparePaths(b, a) })
+	for _, f := range sorted {
+		path, err := atf.SafeJoin(dir, f)
+		if err != nil {
+			errorLog.Printf("Refusing to delete %q: %v", f, err)
+			continue
+		}
+		info, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// the file may be gone already
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = os.Remove(path)
+		} else {
+			err = trash.Move(f, "deleted")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func DownloadFiles(
@@ -268,6 +1271,10 @@ func DownloadFiles(
 	db atf.Stats, 
 	dir string,
 	toRequest []string,
+	ignore *atf.IgnoreRules,
+	versions *atf.Versions,
+	source string,
+	progress *atf.Progress,
 	wg *sync.WaitGroup,
 	errChannel chan error,
 ) {
@@ -282,52 +1289,90 @@ func DownloadFiles(
 		},
 	)
 	log.Printf("DOWNLOAD: Requesting %d files \n", len(files))
+	// the size of a file is only known once the peer sends its info:
+	// the bytes expected grow as the files are received
+	size := func(info atf.FileInfo) int64 {
+		if info.IsDir {
+			return 0
+		}
+		return info.Size
+	}
+	progress.Expect(len(files), 0)
+	failed := make([]string, 0)
 	for _, filename :=  range files {
-		path := filepath.Join(dir, filename)
-		log.Printf("DOWNLOAD: Requesting %s\n", filename)
-		conn.Send([]byte(filename))
-
-		info := new(atf.FileInfo)
-		if err := json.Unmarshal(conn.Recv(), info); err != nil {
-			errChannel <- err
-			return
+		var announced int64
+		path, err := atf.SafeJoin(dir, filename)
+		if err != nil {
+			errorLog.Printf("Refusing to download %q: %v", filename, err)
+			progress.Expect(-1, 0)
+			failed = append(failed, filename)
+			continue
 		}
-		received := 0
-		if info.IsDir {
-			if err := os.MkdirAll(path, info.Mode); err != nil {
-				errChannel <- err
-				return
+
+		done, skipped := false, false
+		digest := ""
+		for attempt := 0; attempt <= MAX_RETRIES && !done; attempt++ {
+			log.Printf("DOWNLOAD: Requesting %s\n", filename)
+			conn.Send([]byte(filename))
+
+			header := conn.Recv()
+			if bytes.HasPrefix(header, ERR) {
+				warnLog.Printf("DOWNLOAD: peer refused %s: %s", filename, header[len(ERR):])
+				break
 			}
-		} else {	
-			file, err := os.Create(path)
-			if err != nil {
+			info := new(atf.FileInfo)
+			if err := json.Unmarshal(header, info); err != nil {
 				errChannel <- err
-				file.Close()
 				return
 			}
+			progress.Expect(0, size(*info)-announced)
+			announced = size(*info)
+			progress.Begin(filename)
+
+			if ignore.Ignored(filename, info.IsDir) {
+				log.Printf("DOWNLOAD: skipping ignored path %s", filename)
+				if !info.IsDir {
+					err := atf.RecvContent(conn, io.Discard, info.Size)
+					if err != nil && !errors.Is(err, atf.ErrIntegrity) {
+						errChannel <- err
+						return
+					}
+				}
+				skipped = true
+				break
+			}
 
-			if err := os.Chmod(path, info.Mode); err != nil {
+			if info.IsDir {
+				err = os.MkdirAll(path, info.Mode)
+			} else {
+				digest, err = ReceiveFile(conn, path, info, progress, func() error {
+					return versions.Archive(filename)
+				})
+			}
+			if errors.Is(err, atf.ErrIntegrity) {
+				warnLog.Printf("DOWNLOAD: %s: %v (attempt %d/%d)", filename, err, attempt+1, MAX_RETRIES+1)
+				progress.Retry()
+				continue
+			}
+			if err != nil {
 				errChannel <- err
-				file.Close()
 				return
 			}
+			done = true
+		}
 
-			for  {
-				chunk := conn.Recv()
-				received += len(chunk)	
-				_, err := file.Write(chunk)
-				if err != nil {
-					file.Close()
-					errChannel <- err
-					return
-				}
-				log.Printf("DOWNLOAD:\treceived %5d/%5d",received,info.Size)
-				if int64(received) == info.Size {
-					break
-				}
-			}
-			file.Close()
+		if skipped || !done {
+			progress.Retry()
+			progress.Expect(-1, -announced)
+		}
+		if skipped {
+			continue
 		}
+		if !done {
+			failed = append(failed, filename)
+			continue
+		}
+		progress.End()
 
 		// update DB with local info
 		FSInfo, err := os.Stat(path)
@@ -336,37 +1381,109 @@ func DownloadFiles(
 			return
 		}
 		newInfo := atf.CloneInfo(FSInfo)	
+		newInfo.Digest = digest
+		if !newInfo.IsDir {
+			versions.SetOrigin(filename, source)
+		}
 		db[filename] = newInfo
 	}
 
 	conn.Send([]byte(":OK"))
+	progress.Finish()
+	if len(failed) > 0 {
+		errorLog.Printf("Failed to download %d files: %v", len(failed), failed)
+	}
 	log.Printf("DOWNLOAD: finished requests")
 }
 
+// Receives the content of a file into a partial file, which replaces
+// path only if its size and digest are verified.
+// replace is called right before, to set the current file aside.
+// Returns the hex digest of the content.
+func ReceiveFile(conn dc.IOChannel, path string, info *atf.FileInfo, progress *atf.Progress, replace func() error) (string, error) {
+	partial := atf.PartialName(path)
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
 
+	h := atf.NewDigest()
+	err = atf.RecvContent(conn, progress.Writer(io.MultiWriter(file, h)), info.Size)
+	file.Close()
+	if err == nil {
+		err = os.Chmod(partial, info.Mode)
+	}
+	if err == nil {
+		err = replace()
+	}
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+
+// Serves the files requested by the peer.
+// Only paths in allowed are served: for the others an error frame is sent.
 func SendFiles(
 	conn dc.IOChannel,
 	db atf.Stats,
+	allowed map[string]bool,
 	dir string,
+	progress *atf.Progress,
 	wg *sync.WaitGroup,
 	errChannel chan error,
 ) {
 	defer wg.Done()	
-	buf := make([]byte, CHUNK_SIZE)
 
 	for {
-		requested := string(conn.Recv())
+		msg := conn.Recv()
+		if msg == nil {
+			errChannel <- errors.New("SEND: channel closed")
+			return
+		}
+		requested := string(msg)
 		if requested == ":OK" {
 			break
 		}
 		log.Printf("SEND: got request %s", requested)
+		if !allowed[requested] {
+			warnLog.Printf("SEND: refusing unauthorized request for %q", requested)
+			conn.Send(slices.Concat(ERR, []byte("not authorized")))
+			continue
+		}
 		info, ok := db[requested]
 		if !ok {
 			errChannel <- fmt.Errorf("SEND: Cannot find file %s in database", requested)
 			return
 		}
 
-		path := filepath.Join(dir, requested)
+		path, err := atf.SafeJoin(dir, requested)
+		if err != nil {
+			errChannel <- err
+			return
+		}
+
+		var file *os.File
+		if !info.IsDir {
+			file, err = os.Open(path)
+			var fsInfo os.FileInfo
+			if err == nil {
+				fsInfo, err = file.Stat()
+			}
+			if err != nil {
+				warnLog.Printf("SEND: cannot read %s: %v", requested, err)
+				conn.Send(slices.Concat(ERR, []byte("cannot read file")))
+				continue
+			}
+			// the file may have changed since the scan
+			info.Size = fsInfo.Size()
+		}
+
 		infoBytes, err := json.Marshal(info)
 		if err != nil {
 			errChannel <- err
@@ -374,30 +1491,22 @@ func SendFiles(
 		}
 
 		conn.Send(infoBytes)
+		// the peer asks for files as it goes: the total is unknown
+		progress.Begin(requested)
 		if info.IsDir {
+			progress.End()
 			continue
 		}
 
-		file, err := os.Open(path)
-		defer file.Close()
+		_, err = atf.SendContent(conn, progress.Reader(file), CHUNK_SIZE)
+		file.Close()
 		if err != nil {
 			errChannel <- err
 			return
 		}
-
-		for {
-			n, err := file.Read(buf)
-			if err != nil && err != io.EOF {
-				errChannel <- err
-				return
-			}
-			chunk := slices.Clone(buf[:n])
-			conn.Send(chunk)
-			if err != nil { // EOF
-				break
-			}
-		}	
+		progress.End()
 	}
 
+	progress.Finish()
 	log.Printf("SEND: finished requests")
 }
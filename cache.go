@@ -0,0 +1,226 @@
+package atf
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"iter"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Cheap metadata of a file: as long as it does not change, the content
+// is assumed not to change either
+type fileKey struct {
+	Dev     uint64 `json:"dev"`
+	Ino     uint64 `json:"ino"`
+	Size    int64  `json:"size"`
+	MtimeNs int64  `json:"mtime"`
+	CtimeNs int64  `json:"ctime"`
+}
+
+type cacheEntry struct {
+	fileKey
+	Digest string `json:"digest"`
+}
+
+// Digests of the files met by the last scan, so that the next one only
+// reads the files whose metadata changed.
+// As in git, entries modified from the second the scan started on are
+// "racy": the file could have changed again within the same mtime tick
+// after being read, so they are never trusted.
+type ScanCache struct {
+	Path    string                `json:"-"`
+	Stamp   time.Time             `json:"stamp"` // start of the scan that filled the cache
+	Entries map[string]cacheEntry `json:"entries"`
+
+	next map[string]cacheEntry
+	mu   sync.Mutex
+}
+
+// Loads the cache stored in path, empty if missing or unreadable
+func LoadScanCache(path string) *ScanCache {
+	c := &ScanCache{Path: path}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		// a corrupted cache only costs a full rescan
+		json.Unmarshal(data, c)
+	}
+	if c.Entries == nil {
+		c.Entries = make(map[string]cacheEntry)
+	}
+	return c
+}
+
+// Writes the cache atomically
+func (c *ScanCache) Save() error {
+	c.mu.Lock()
+	data, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.Path), ".scancache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.Path)
+}
+
+// Scans like CreateStatsParallel, filling the Digest of regular files.
+// Files whose metadata matches cache are not read; the cache is then
+// replaced with the entries of this scan.
+func CreateStatsCached(fsys fs.FS, root string, policy Policy, workers int, cache *ScanCache) (Stats, error) {
+	start := time.Now()
+	cache.mu.Lock()
+	cache.next = make(map[string]cacheEntry, len(cache.Entries))
+	cache.mu.Unlock()
+
+	stats, err := scanParallel(fsys, root, policy, workers, cache.clone(fsys))
+	if err != nil {
+		return stats, err
+	}
+
+	cache.mu.Lock()
+	cache.Entries, cache.next = cache.next, nil
+	cache.Stamp = start
+	cache.mu.Unlock()
+	return stats, nil
+}
+
+// Scans like ScanSeq, filling the Digest of regular files as
+// CreateStatsCached does, with up to workers files read at the same time
+// (one per CPU if not positive). Only a bounded window of entries is
+// held while their files are read, and they are yielded in ComparePaths
+// order.
+// The cache is only replaced once the whole tree is scanned: an error,
+// stored in err, or an early stop leave it as it was.
+func (c *ScanCache) Seq(fsys fs.FS, root string, policy Policy, workers int, err *error) iter.Seq2[string, FileInfo] {
+	return func(yield func(string, FileInfo) bool) {
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		start := time.Now()
+		c.mu.Lock()
+		c.next = make(map[string]cacheEntry, len(c.Entries))
+		c.mu.Unlock()
+		clone := c.clone(fsys)
+
+		type result struct {
+			rel  string
+			info FileInfo
+			err  error
+			done chan struct{}
+		}
+		// entries in walk order, read by at most workers goroutines
+		window := make(chan *result, 4*workers)
+		reading := make(chan struct{}, workers)
+		stop := make(chan struct{})
+		// the files being read are waited for, even on an early stop
+		var wg sync.WaitGroup
+		defer func() {
+			close(stop)
+			wg.Wait()
+		}()
+		var walkErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(window)
+			for rel, entry := range walkSeq(fsys, root, policy, &walkErr) {
+				r := &result{rel: rel, done: make(chan struct{})}
+				select {
+				case window <- r:
+				case <-stop:
+					return
+				}
+				select {
+				case reading <- struct{}{}:
+				case <-stop:
+					return
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r.info, r.err = clone(entry.path, rel, entry.info)
+					<-reading
+					close(r.done)
+				}()
+			}
+		}()
+
+		for r := range window {
+			<-r.done
+			if r.err != nil {
+				*err = r.err
+				return
+			}
+			if !yield(r.rel, r.info) {
+				return
+			}
+		}
+		if walkErr != nil {
+			*err = walkErr
+			return
+		}
+		c.mu.Lock()
+		c.Entries, c.next = c.next, nil
+		c.Stamp = start
+		c.mu.Unlock()
+	}
+}
+
+func (c *ScanCache) clone(fsys fs.FS) func(p, rel string, info fs.FileInfo) (FileInfo, error) {
+	return func(p, rel string, info fs.FileInfo) (FileInfo, error) {
+		stat := CloneInfo(info)
+		if !info.Mode().IsRegular() {
+			return stat, nil
+		}
+
+		key := statKey(info)
+		c.mu.Lock()
+		entry, ok := c.Entries[rel]
+		racy := key.MtimeNs >= c.Stamp.Truncate(time.Second).UnixNano()
+		c.mu.Unlock()
+
+		if !ok || entry.fileKey != key || racy {
+			digest, err := digestFile(fsys, p)
+			if err != nil {
+				return stat, err
+			}
+			entry = cacheEntry{key, digest}
+		}
+		stat.Digest = entry.Digest
+
+		c.mu.Lock()
+		c.next[rel] = entry
+		c.mu.Unlock()
+		return stat, nil
+	}
+}
+
+// Returns the hex SHA-256 of the content of the file p
+func digestFile(fsys fs.FS, p string) (string, error) {
+	file, err := fsys.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := NewDigest()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
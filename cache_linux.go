@@ -0,0 +1,17 @@
+package atf
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Returns the cache key of a file, from its stat data when available
+func statKey(info fs.FileInfo) fileKey {
+	key := fileKey{Size: info.Size(), MtimeNs: info.ModTime().UnixNano()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		key.Dev = uint64(st.Dev)
+		key.Ino = uint64(st.Ino)
+		key.CtimeNs = int64(st.Ctim.Sec)*1e9 + int64(st.Ctim.Nsec)
+	}
+	return key
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package atf
+
+import "io/fs"
+
+// Returns the cache key of a file. Device, inode and change time are
+// not portable, so only size and modification time are used.
+func statKey(info fs.FileInfo) fileKey {
+	return fileKey{Size: info.Size(), MtimeNs: info.ModTime().UnixNano()}
+}
@@ -0,0 +1,174 @@
+package atf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fs.FS counting the files opened
+type countingFS struct {
+	fs.FS
+	mu     sync.Mutex
+	opened []string
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	if strings.HasSuffix(name, ".txt") {
+		c.mu.Lock()
+		c.opened = append(c.opened, name)
+		c.mu.Unlock()
+	}
+	return c.FS.Open(name)
+}
+
+func (c *countingFS) reset() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	opened := c.opened
+	c.opened = nil
+	return opened
+}
+
+func TestScanCache(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_cache"})
+	defer os.RemoveAll(root)
+	old := time.Now().Add(-time.Hour)
+	write := func(name, content string, mtime time.Time) {
+		p := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, mtime, mtime)
+	}
+	write("a.txt", "alpha", old)
+	write("d/b.txt", "bravo", old)
+
+	fsys := &countingFS{FS: os.DirFS(root)}
+	cachePath := filepath.Join(t.TempDir(), "cache")
+	scan := func() Stats {
+		cache := LoadScanCache(cachePath)
+		stats, err := CreateStatsCached(fsys, ".", IncludeAll, 2, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	stats := scan()
+	sum := sha256.Sum256([]byte("alpha"))
+	if stats["a.txt"].Digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("Wrong digest %q", stats["a.txt"].Digest)
+	}
+	if stats["d"].Digest != "" {
+		t.Errorf("Directory with a digest")
+	}
+	if opened := fsys.reset(); len(opened) != 2 {
+		t.Errorf("First scan should read every file, read %v", opened)
+	}
+
+	again := scan()
+	if opened := fsys.reset(); len(opened) != 0 {
+		t.Errorf("Unchanged files read again: %v", opened)
+	}
+	if again["a.txt"] != stats["a.txt"] {
+		t.Errorf("Cached scan differs: %v, %v", again["a.txt"], stats["a.txt"])
+	}
+
+	// same size and mtime: only the change time tells
+	write("a.txt", "alpha", old)
+	write("d/b.txt", "BRAVO", old)
+	stats = scan()
+	if runtime.GOOS == "linux" {
+		if opened := fsys.reset(); len(opened) != 2 {
+			t.Errorf("Rewritten files not read again: %v", opened)
+		}
+		sum = sha256.Sum256([]byte("BRAVO"))
+		if stats[filepath.Join("d", "b.txt")].Digest != hex.EncodeToString(sum[:]) {
+			t.Errorf("Stale digest for a changed file")
+		}
+	}
+	fsys.reset()
+
+	// racy: modified in the same second the scan started
+	write("a.txt", "alpha", time.Now())
+	scan()
+	fsys.reset()
+	scan()
+	if opened := fsys.reset(); len(opened) != 1 || opened[0] != "a.txt" {
+		t.Errorf("Racy file not read again: %v", opened)
+	}
+}
+
+func TestScanCacheSeq(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_cache_seq"})
+	MakePlayground(root, []string{"a/f1.txt", "a/f2.txt", "a.txt", "b/c/f3.txt"})
+	defer os.RemoveAll(root)
+	// older than any scan, so that the cache is trusted
+	old := time.Now().Add(-time.Hour)
+	filepath.WalkDir(root, func(p string, _ fs.DirEntry, _ error) error {
+		return os.Chtimes(p, old, old)
+	})
+	fsys := &countingFS{FS: os.DirFS(root)}
+	expected, err := CreateStatsCached(fsys, ".", IncludeAll, 2, LoadScanCache(filepath.Join(t.TempDir(), "cache")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.reset()
+
+	cache := LoadScanCache(filepath.Join(t.TempDir(), "cache"))
+	// stopped early, the scan leaves the cache as it was
+	var scanErr error
+	for range cache.Seq(fsys, ".", IncludeAll, 2, &scanErr) {
+		break
+	}
+	if len(cache.Entries) != 0 {
+		t.Errorf("Cache filled by a partial scan")
+	}
+	fsys.reset()
+
+	keys := make([]string, 0)
+	stats := make(Stats)
+	for p, info := range cache.Seq(fsys, ".", IncludeAll, 2, &scanErr) {
+		keys = append(keys, p)
+		stats[p] = info
+	}
+	if scanErr != nil {
+		t.Fatal(scanErr)
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected %v, got %v", expected, stats)
+	}
+	if !slices.IsSortedFunc(keys, ComparePaths) {
+		t.Errorf("Entries not in ComparePaths order: %v", keys)
+	}
+	if opened := fsys.reset(); len(opened) != 4 || len(cache.Entries) != 4 {
+		t.Errorf("Expected 4 files read and cached, read %v", opened)
+	}
+	for range cache.Seq(fsys, ".", IncludeAll, 2, &scanErr) {
+	}
+	if opened := fsys.reset(); len(opened) != 0 {
+		t.Errorf("Unchanged files read again: %v", opened)
+	}
+}
+
+func TestScanCacheCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	os.WriteFile(path, []byte("{not json"), 0644)
+	if cache := LoadScanCache(path); len(cache.Entries) != 0 {
+		t.Errorf("Corrupted cache not discarded")
+	}
+}
@@ -0,0 +1,381 @@
+package atf
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+// Version of the session protocol, announced in Hello
+const ProtocolVersion = 3
+
+// First message exchanged by two peers, always sent in clear.
+// Ephemeral is a fresh X25519 public key, from which the session key
+// is agreed; PSK tells whether a shared secret authenticates the peers.
+type Hello struct {
+	Version   int    `json:"version"`
+	PSK       bool   `json:"psk"`
+	KDF       string `json:"kdf,omitempty"`
+	Salt      []byte `json:"salt,omitempty"`
+	Identity  []byte `json:"identity,omitempty"`
+	Nonce     []byte `json:"nonce"`
+	Ephemeral []byte `json:"ephemeral"`
+}
+
+// Parameters of a handshake.
+// Identity enables device authentication: peers sign the handshake
+// transcript and the remote key is checked against Peers, where it is
+// pinned under PeerName.
+type HandshakeConfig struct {
+	Secret   *Secret
+	Identity *Identity
+	Peers    *KnownPeers
+	PeerName string
+}
+
+// Outcome of a handshake
+type Session struct {
+	Cypher *dc.AESGCM        // nil if the session is not encrypted
+	Peer   ed25519.PublicKey // nil if the peer is not authenticated
+}
+
+// Secret shared by the peers, used to authenticate each other:
+// either a raw AES key or a passphrase. Passphrases are stretched with
+// scrypt, salted with the salts of both peers.
+type Secret struct {
+	Key        []byte
+	Passphrase []byte
+	Salt       []byte
+}
+
+var ErrKeyMismatch = errors.New("encryption key mismatch: peers use different keys")
+var ErrAuthFailed = errors.New("peer authentication failed")
+
+const authContext = "allthoughtsfile handshake v2"
+
+var keyCheck = []byte("allthoughtsfile key check")
+
+const sessionKeyInfo = "allthoughtsfile session key"
+const confirmContext = "allthoughtsfile key confirmation"
+
+// Reads an AES key file
+func LoadKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// validate it early rather than at handshake time
+	if _, err := dc.NewAESGCM(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Builds the Secret selected by the -aes and -passphrase flags.
+// Returns nil if encryption was not requested.
+func MakeSecret(keyFile string, passphrase bool, salt []byte) (*Secret, error) {
+	switch {
+	case keyFile != "" && passphrase:
+		return nil, errors.New("-aes and -passphrase are mutually exclusive")
+	case keyFile != "":
+		key, err := LoadKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &Secret{Key: key}, nil
+	case passphrase:
+		p, err := ReadPassphrase("Passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		return &Secret{Passphrase: p, Salt: salt}, nil
+	}
+	return nil, nil
+}
+
+func (s *Secret) kdf() string {
+	if s != nil && s.Passphrase != nil {
+		return "scrypt"
+	}
+	return ""
+}
+
+// Runs the session handshake over c: exchanges Hello messages,
+// authenticates the peer with the configured Identity and/or Secret and
+// agrees on a session key through ephemeral X25519 Diffie-Hellman.
+// The static secret and the identity only authenticate the transcript,
+// so a leaked key file does not expose past sessions.
+// The session is encrypted whenever the peer is authenticated; with
+// neither an identity nor a secret it runs in clear.
+// Both peers must call Handshake before sending anything else, so that
+// a missing or wrong key is reported as such rather than surfacing as
+// garbled protocol messages. Every step is symmetric, so that when one
+// side fails the other learns about it instead of waiting.
+func Handshake(c dc.IOChannel, cfg *HandshakeConfig) (*Session, error) {
+	secret := cfg.Secret
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	local := Hello{
+		Version:   ProtocolVersion,
+		PSK:       secret != nil,
+		KDF:       secret.kdf(),
+		Nonce:     dc.CreateKey(32),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+	}
+	if local.KDF != "" {
+		local.Salt = secret.Salt
+	}
+	if cfg.Identity != nil {
+		local.Identity = cfg.Identity.Public()
+	}
+	localBytes, _ := json.Marshal(local)
+	c.Send(localBytes)
+
+	var remote Hello
+	remoteBytes := c.Recv()
+	if err := json.Unmarshal(remoteBytes, &remote); err != nil {
+		return nil, fmt.Errorf("invalid hello from peer: %w", err)
+	}
+	if remote.Version != ProtocolVersion {
+		return nil, fmt.Errorf("peer speaks protocol version %d, expected %d",
+			remote.Version, ProtocolVersion)
+	}
+	if bytes.Equal(localBytes, remoteBytes) {
+		return nil, fmt.Errorf("%w: reflected hello", ErrAuthFailed)
+	}
+	if remote.PSK != local.PSK {
+		return nil, fmt.Errorf("shared key configured on one side only (local: %t, peer: %t)",
+			local.PSK, remote.PSK)
+	}
+	if remote.KDF != local.KDF {
+		return nil, errors.New("one peer uses a passphrase, the other a key file")
+	}
+	if (remote.Identity == nil) != (local.Identity == nil) {
+		return nil, errors.New("device authentication enabled on one side only")
+	}
+
+	session := new(Session)
+	transcript := Transcript(localBytes, remoteBytes)
+	if cfg.Identity != nil {
+		if err := authenticate(c, cfg, remote.Identity, transcript); err != nil {
+			return nil, err
+		}
+		session.Peer = remote.Identity
+	}
+	if secret != nil {
+		if err := confirmSecret(c, secret, local, remote, localBytes, remoteBytes, transcript); err != nil {
+			return nil, err
+		}
+	}
+	if secret == nil && cfg.Identity == nil {
+		return session, nil
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(remote.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key from peer: %w", err)
+	}
+	shared, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, shared, transcript, sessionKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	cypher, err := dc.NewAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	secure := NewSecureChannel(c, cypher)
+	secure.Send(keyCheck)
+	if check := secure.Recv(); check == nil || !slices.Equal(check, keyCheck) {
+		return nil, ErrKeyMismatch
+	}
+	session.Cypher = cypher
+	return session, nil
+}
+
+// Proves knowledge of the shared secret with a MAC of the transcript,
+// bound to the sender's own hello so that it cannot be reflected.
+func confirmSecret(
+	c dc.IOChannel,
+	secret *Secret,
+	local, remote Hello,
+	localBytes, remoteBytes, transcript []byte,
+) error {
+	key := secret.Key
+	if local.KDF != "" {
+		var err error
+		key, err = DeriveKey(secret.Passphrase, CombineSalts(local.Salt, remote.Salt))
+		if err != nil {
+			return err
+		}
+	}
+
+	confirmation := func(hello []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(confirmContext))
+		mac.Write(transcript)
+		mac.Write(hello)
+		return mac.Sum(nil)
+	}
+	c.Send(confirmation(localBytes))
+	if !hmac.Equal(c.Recv(), confirmation(remoteBytes)) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// Hash of the two hello messages, independent of who sent which
+func Transcript(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha256.New()
+	h.Write([]byte(authContext))
+	for _, m := range [][]byte{a, b} {
+		binary.Write(h, binary.BigEndian, uint64(len(m)))
+		h.Write(m)
+	}
+	return h.Sum(nil)
+}
+
+// Proves possession of the local identity by signing transcript,
+// checks the peer's signature and pins its key.
+// Ends with an exchange of verdicts, so that both sides learn whether
+// the other accepted them.
+func authenticate(c dc.IOChannel, cfg *HandshakeConfig, peer ed25519.PublicKey, transcript []byte) error {
+	c.Send(ed25519.Sign(cfg.Identity.Key, transcript))
+	signature := c.Recv()
+
+	var err error
+	if len(peer) != ed25519.PublicKeySize || !ed25519.Verify(peer, transcript, signature) {
+		err = fmt.Errorf("%w: bad signature", ErrAuthFailed)
+	} else if cfg.Peers != nil {
+		err = cfg.Peers.Verify(cfg.PeerName, peer)
+	}
+
+	if err != nil {
+		c.Send([]byte("KO"))
+	} else {
+		c.Send([]byte("OK"))
+	}
+	verdict := string(c.Recv())
+	if err != nil {
+		return err
+	}
+	if verdict != "OK" {
+		return fmt.Errorf("%w: the peer refused our identity %s", ErrAuthFailed,
+			cfg.Identity.Fingerprint())
+	}
+	return nil
+}
+
+// IOChannel encrypting every message with AES-GCM.
+// Messages are laid out as dc.AESConnection does (ciphertext || nonce),
+// but failures never block or panic: they are reported on Err, when
+// someone listens, and Recv returns nil.
+// Every message is numbered within its direction, so that replayed,
+// reordered or dropped messages are rejected, and carries a random id of
+// the channel that sent it, so that it cannot be reflected back.
+type SecureChannel struct {
+	Conn   dc.IOChannel
+	Cypher *dc.AESGCM
+	Err    chan error
+
+	sendMu, recvMu sync.Mutex
+	id, peerID     []byte
+	sent, received uint64
+}
+
+// Length of the header numbering the messages: the id of the sending
+// channel, then the sequence number
+const seqHeaderSize = 16
+
+func NewSecureChannel(conn dc.IOChannel, cypher *dc.AESGCM) *SecureChannel {
+	return &SecureChannel{Conn: conn, Cypher: cypher, Err: make(chan error, 1), id: dc.CreateKey(8)}
+}
+
+func (c *SecureChannel) report(err error) {
+	select {
+	case c.Err <- err:
+	default:
+	}
+}
+
+func (c *SecureChannel) Send(b []byte) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	header := binary.BigEndian.AppendUint64(slices.Clone(c.id), c.sent)
+	nonce := c.Cypher.GenerateNonce()
+	msg, err := c.Cypher.Encrypt(slices.Concat(header, b), nonce)
+	if err != nil {
+		c.report(err)
+		return
+	}
+	c.sent++
+	c.Conn.Send(slices.Concat(msg, nonce))
+}
+
+func (c *SecureChannel) Recv() []byte {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	msg := c.Conn.Recv()
+	nonceOffset := len(msg) - c.Cypher.NonceSize()
+	if nonceOffset < 0 {
+		c.report(errors.New("decryption failed: message too short"))
+		return nil
+	}
+	plaintext, err := c.Cypher.Decrypt(msg[:nonceOffset], msg[nonceOffset:])
+	if err != nil {
+		c.report(fmt.Errorf("decryption failed, data tampered or key changed: %w", err))
+		return nil
+	}
+	if len(plaintext) < seqHeaderSize {
+		c.report(errors.New("decryption failed: message not numbered"))
+		return nil
+	}
+	id, seq := plaintext[:8], binary.BigEndian.Uint64(plaintext[8:seqHeaderSize])
+	// the peer's id is learnt from its first message
+	if c.peerID == nil && seq == 0 && !bytes.Equal(id, c.id) {
+		c.peerID = slices.Clone(id)
+	}
+	if !bytes.Equal(id, c.peerID) || seq != c.received {
+		c.report(fmt.Errorf("message %d out of sequence, expected %d: replayed, reordered or dropped", seq, c.received))
+		return nil
+	}
+	c.received++
+	return plaintext[seqHeaderSize:]
+}
+
+// Wraps c in a SecureChannel if cypher is not nil, forwarding its
+// errors to errChannel. Otherwise c is returned as is.
+func Secure(c dc.IOChannel, cypher *dc.AESGCM, errChannel chan error) dc.IOChannel {
+	if cypher == nil {
+		return c
+	}
+	secure := NewSecureChannel(c, cypher)
+	go func() {
+		if err, ok := <-secure.Err; ok {
+			errChannel <- err
+		}
+	}()
+	return secure
+}
@@ -0,0 +1,273 @@
+package atf
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+func runHandshakes(s1, s2 *Secret) (error, error) {
+	return runConfigHandshakes(&HandshakeConfig{Secret: s1}, &HandshakeConfig{Secret: s2})
+}
+
+func runConfigHandshakes(cfg1, cfg2 *HandshakeConfig) (error, error) {
+	_, _, err1, err2 := runSessions(cfg1, cfg2)
+	return err1, err2
+}
+
+func runSessions(cfg1, cfg2 *HandshakeConfig) (*Session, *Session, error, error) {
+	p1, p2 := MakePipes(4)
+	type result struct {
+		session *Session
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		session, err := Handshake(p1, cfg1)
+		results <- result{session, err}
+	}()
+	session2, err2 := Handshake(p2, cfg2)
+	r := <-results
+	return r.session, session2, r.err, err2
+}
+
+func TestHandshake(t *testing.T) {
+	key := dc.CreateKey(32)
+	s1 := &Secret{Key: key}
+	s2 := &Secret{Key: key}
+	other := &Secret{Key: dc.CreateKey(32)}
+
+	if err1, err2 := runHandshakes(nil, nil); err1 != nil || err2 != nil {
+		t.Errorf("Plain handshake failed: %v, %v", err1, err2)
+	}
+	if err1, err2 := runHandshakes(s1, s2); err1 != nil || err2 != nil {
+		t.Errorf("Encrypted handshake failed: %v, %v", err1, err2)
+	}
+	err1, err2 := runHandshakes(s1, other)
+	if !errors.Is(err1, ErrKeyMismatch) || !errors.Is(err2, ErrKeyMismatch) {
+		t.Errorf("Expected key mismatch, got %v, %v", err1, err2)
+	}
+	if err1, err2 := runHandshakes(s1, nil); err1 == nil || err2 == nil {
+		t.Errorf("Expected encryption mismatch errors")
+	}
+}
+
+func TestPassphraseHandshake(t *testing.T) {
+	p1 := &Secret{Passphrase: []byte("correct horse"), Salt: dc.CreateKey(SaltSize)}
+	p2 := &Secret{Passphrase: []byte("correct horse"), Salt: dc.CreateKey(SaltSize)}
+	wrong := &Secret{Passphrase: []byte("battery staple"), Salt: dc.CreateKey(SaltSize)}
+
+	if err1, err2 := runHandshakes(p1, p2); err1 != nil || err2 != nil {
+		t.Errorf("Passphrase handshake failed: %v, %v", err1, err2)
+	}
+	err1, err2 := runHandshakes(p1, wrong)
+	if !errors.Is(err1, ErrKeyMismatch) || !errors.Is(err2, ErrKeyMismatch) {
+		t.Errorf("Expected key mismatch, got %v, %v", err1, err2)
+	}
+	if err1, err2 := runHandshakes(p1, &Secret{Key: dc.CreateKey(32)}); err1 == nil || err2 == nil {
+		t.Errorf("Expected KDF mismatch errors")
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	r := strings.NewReader("secret\nnext\nlast")
+	for _, expected := range []string{"secret", "next", "last"} {
+		// nothing past a line is consumed
+		if line, err := readLine(r); err != nil || string(line) != expected {
+			t.Errorf("Expected %q, got %q (%v)", expected, line, err)
+		}
+	}
+	if _, err := readLine(r); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestSecureChannel(t *testing.T) {
+	cypher, _ := dc.NewAESGCM(dc.CreateKey(32))
+	p1, p2 := MakePipes(4)
+	s1 := NewSecureChannel(p1, cypher)
+	s2 := NewSecureChannel(p2, cypher)
+
+	msg := []byte("hello")
+	s1.Send(msg)
+	if got := s2.Recv(); !slices.Equal(got, msg) {
+		t.Errorf("Expected %s, got %s", msg, got)
+	}
+
+	s1.Send(msg)
+	tampered := <-p1.In
+	tampered[0] ^= 0xff
+	p1.In <- tampered
+	if got := s2.Recv(); got != nil {
+		t.Errorf("Tampered message accepted: %s", got)
+	}
+	select {
+	case <-s2.Err:
+	default:
+		t.Errorf("Tampering not reported")
+	}
+
+	p1.Send([]byte{1})
+	if got := s2.Recv(); got != nil {
+		t.Errorf("Short message accepted: %v", got)
+	}
+}
+
+func TestSecureChannelSequence(t *testing.T) {
+	cypher, _ := dc.NewAESGCM(dc.CreateKey(32))
+	p1, p2 := MakePipes(4)
+	s1, s2 := NewSecureChannel(p1, cypher), NewSecureChannel(p2, cypher)
+	// captures the next message sent by s1, leaving it undelivered
+	capture := func(msg string) []byte {
+		s1.Send([]byte(msg))
+		return <-p1.In
+	}
+	expect := func(want string) {
+		t.Helper()
+		if got := s2.Recv(); string(got) != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+	first := capture("first")
+	p1.In <- first
+	expect("first")
+
+	// replayed
+	p1.In <- first
+	expect("")
+	// reordered, or one dropped
+	s2 = NewSecureChannel(p2, cypher)
+	s1 = NewSecureChannel(p1, cypher)
+	a, b := capture("a"), capture("b")
+	p1.In <- b
+	expect("")
+	s2 = NewSecureChannel(p2, cypher)
+	p1.In <- a
+	expect("a")
+	p1.In <- b
+	expect("b")
+
+	// reflected back to its sender
+	s2 = NewSecureChannel(p2, cypher)
+	s2.Send([]byte("echo"))
+	p1.In <- <-p2.In
+	expect("")
+}
+
+func TestIdentityHandshake(t *testing.T) {
+	dir := GetTmpName([]string{"atf", "test_identity"})
+	defer os.RemoveAll(dir)
+
+	loadDevice := func(name string) (*Identity, *KnownPeers) {
+		id, err := LoadOrCreateIdentity(filepath.Join(dir, name, IdentityFile))
+		if err != nil {
+			t.Fatalf("Cannot create identity: %v", err)
+		}
+		peers, err := LoadKnownPeers(filepath.Join(dir, name, KnownPeersFile))
+		if err != nil {
+			t.Fatalf("Cannot load known peers: %v", err)
+		}
+		return id, peers
+	}
+	idA, peersA := loadDevice("a")
+	idB, peersB := loadDevice("b")
+	idEvil, peersEvil := loadDevice("evil")
+
+	reloaded, _ := LoadOrCreateIdentity(filepath.Join(dir, "a", IdentityFile))
+	if reloaded.Fingerprint() != idA.Fingerprint() {
+		t.Fatalf("Identity not persisted")
+	}
+
+	cfgA := &HandshakeConfig{Identity: idA, Peers: peersA, PeerName: "room"}
+	cfgB := &HandshakeConfig{Identity: idB, Peers: peersB, PeerName: "room"}
+	if err1, err2 := runConfigHandshakes(cfgA, cfgB); err1 != nil || err2 != nil {
+		t.Fatalf("First handshake failed: %v, %v", err1, err2)
+	}
+	if err1, err2 := runConfigHandshakes(cfgA, cfgB); err1 != nil || err2 != nil {
+		t.Fatalf("Pinned handshake failed: %v, %v", err1, err2)
+	}
+
+	reloadedPeers, _ := LoadKnownPeers(peersA.Path)
+	if reloadedPeers.All()["room"] != idB.Fingerprint() {
+		t.Errorf("Peer not pinned: %v", reloadedPeers.All())
+	}
+
+	cfgEvil := &HandshakeConfig{Identity: idEvil, Peers: peersEvil, PeerName: "room"}
+	err1, err2 := runConfigHandshakes(cfgA, cfgEvil)
+	if !errors.Is(err1, ErrPeerChanged) {
+		t.Errorf("Expected changed identity error, got %v", err1)
+	}
+	if !errors.Is(err2, ErrAuthFailed) {
+		t.Errorf("Expected refusal, got %v", err2)
+	}
+
+	// a forgotten peer is pinned again on first use
+	if err := peersA.Forget("room"); err != nil {
+		t.Fatalf("Cannot forget peer: %v", err)
+	}
+	if err := peersA.Forget("room"); err == nil {
+		t.Errorf("Forgot an unknown peer")
+	}
+	if reloadedPeers, _ := LoadKnownPeers(peersA.Path); len(reloadedPeers.All()) != 0 {
+		t.Errorf("Peer still pinned: %v", reloadedPeers.All())
+	}
+	if err1, err2 := runConfigHandshakes(cfgA, cfgEvil); err1 != nil || err2 != nil {
+		t.Errorf("Handshake with a forgotten peer failed: %v, %v", err1, err2)
+	}
+
+	if err1, err2 := runConfigHandshakes(cfgA, &HandshakeConfig{}); err1 == nil || err2 == nil {
+		t.Errorf("Expected authentication mismatch errors")
+	}
+}
+
+func TestSessionKeys(t *testing.T) {
+	key := dc.CreateKey(32)
+	cfg := &HandshakeConfig{Secret: &Secret{Key: key}}
+
+	// both sides agree on the session key, which is fresh every time
+	s1, s2, err1, err2 := runSessions(cfg, cfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Handshake failed: %v, %v", err1, err2)
+	}
+	p1, p2 := MakePipes(1)
+	msg := []byte("hello")
+	NewSecureChannel(p1, s1.Cypher).Send(msg)
+	if got := NewSecureChannel(p2, s2.Cypher).Recv(); !slices.Equal(got, msg) {
+		t.Errorf("Peers derived different session keys")
+	}
+
+	s3, _, err1, err2 := runSessions(cfg, cfg)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Handshake failed: %v, %v", err1, err2)
+	}
+	NewSecureChannel(p1, s3.Cypher).Send(msg)
+	if got := NewSecureChannel(p2, s2.Cypher).Recv(); got != nil {
+		t.Errorf("Session key reused across handshakes")
+	}
+
+	// the static key alone does not decrypt the session
+	static, _ := dc.NewAESGCM(key)
+	NewSecureChannel(p1, s1.Cypher).Send(msg)
+	if got := NewSecureChannel(p2, static).Recv(); got != nil {
+		t.Errorf("Session encrypted with the static key")
+	}
+
+	// plain sessions stay in clear
+	if s1, _, _, _ := runSessions(&HandshakeConfig{}, &HandshakeConfig{}); s1.Cypher != nil {
+		t.Errorf("Unauthenticated session is encrypted")
+	}
+}
+
+func TestReflectedHandshake(t *testing.T) {
+	echo := make(chan []byte, 4)
+	cfg := &HandshakeConfig{Secret: &Secret{Key: dc.CreateKey(32)}}
+	if _, err := Handshake(&Pipe{In: echo, Out: echo}, cfg); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected reflection to be refused, got %v", err)
+	}
+}
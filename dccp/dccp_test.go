@@ -1,5 +1,7 @@
 package main_test 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
@@ -60,7 +62,7 @@ func TestFile(t *testing.T) {
 			return
 		}
 		sync <- true
-		err = dccp.Send(conn1, input_path)
+		err = dccp.Send(conn1, input_path, nil)
 		if err != nil {
 			t.Errorf("Error while sending: %v", err)
 		}
@@ -77,10 +79,14 @@ func TestFile(t *testing.T) {
 	}
 
 	<-sync
-	err = dccp.Receive(conn2, out_dir)
+	var last atf.ProgressEvent
+	err = dccp.Receive(conn2, out_dir, atf.NewProgress("recv", func(e atf.ProgressEvent) { last = e }))
 	if err != nil {
 		t.Errorf("Error while receiving: %v", err)
 	}
+	if !last.Finished || last.FilesDone != 1 || last.BytesDone != int64(len(payload)) {
+		t.Errorf("Unexpected progress %+v", last)
+	}
 
 	<-sync
 	read_buf, err := os.ReadFile(output_path)
@@ -140,7 +146,7 @@ func TestDir(t *testing.T) {
 			return
 		}
 		sync <- true
-		err = dccp.Send(conn1, in_dir)
+		err = dccp.Send(conn1, in_dir, nil)
 		if err != nil {
 			t.Errorf("Error while sending: %v", err)
 		}
@@ -157,7 +163,7 @@ func TestDir(t *testing.T) {
 	}
 
 	<-sync
-	err = dccp.Receive(conn2, out_dir)
+	err = dccp.Receive(conn2, out_dir, nil)
 	if err != nil {
 		t.Errorf("Error while receiving: %v", err)
 	}
@@ -232,7 +238,7 @@ func TestCrypt(t *testing.T) {
 		}
 		chann := dc.NewAESConnection(conn1, cypher)
 		sync <- true
-		err = dccp.Send(chann, input_path)
+		err = dccp.Send(chann, input_path, nil)
 		if err != nil {
 			t.Errorf("Error while sending: %v", err)
 		}
@@ -249,7 +255,7 @@ func TestCrypt(t *testing.T) {
 	}
 	chann := dc.NewAESConnection(conn2, cypher)
 	<-sync
-	err = dccp.Receive(chann, out_dir)
+	err = dccp.Receive(chann, out_dir, nil)
 	if err != nil {
 		t.Errorf("Error while receiving: %v", err)
 	}
@@ -294,3 +300,51 @@ func TestCLI(t *testing.T) {
 	os.RemoveAll(root2)
 	os.RemoveAll(settingsPath)
 }
+
+func TestWormholeCLI(t *testing.T) {
+	root1 := atf.GetTmpName([]string{"dccp", "test_wormhole", "src"})
+	atf.MakePlayground(root1, []string{"f1.txt"})
+	root2 := atf.GetTmpName([]string{"dccp", "test_wormhole", "dest"})
+	atf.MakePlayground(root2, []string{""})
+
+	filePath := filepath.Join(root1, "f1.txt")
+	os.WriteFile(filePath, []byte("hello"), 0644)
+
+	// the room comes from the code, whatever the key in the settings
+	settingsPath, err := atf.MakeSettings("unused")
+	if err != nil {
+		t.Fatalf("Error while writing settings: %v", err)
+	}
+	code, err := atf.GenerateCode()
+	if err != nil {
+		t.Fatalf("Error while generating the code: %v", err)
+	}
+
+	arg1 := []string{"run", "main.go",
+		"--debug", "--settings", settingsPath, "--code", code, "send", filePath}
+	arg2 := []string{"run", "main.go",
+		"--debug", "--settings", settingsPath, "--code", code, "recv", root2}
+	atf.RunPrg(arg1,arg2,t)
+	atf.CheckEqual(root1,root2,t)
+
+	os.RemoveAll(root1)
+	os.RemoveAll(root2)
+	os.RemoveAll(settingsPath)
+}
+
+// the reply of the signaling server is only known by its text
+func TestTimedOut(t *testing.T) {
+	settings := dc.ConnectionSettings{
+		Signaling:  "ws://0.0.0.0:8080",
+		Key:        fmt.Sprintf("alone%d", rand.Int()),
+		BufferSize: 1024,
+	}
+	// nobody joins the room
+	_, err := dc.FromSettings(&settings)
+	if err == nil || !dccp.TimedOut(err) {
+		t.Errorf("Timeout of the signaling server not recognized: %v", err)
+	}
+	if dccp.TimedOut(errors.New("Bad response: Fatal: room taken")) {
+		t.Errorf("Other replies taken for a timeout")
+	}
+}
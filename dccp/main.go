@@ -1,24 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"slices"
+	"os/exec"
 
 	dc "github.com/leogem2003/directchan"
 	atf "github.com/leogem2003/allthoughtsfiles"
 )
 
+const CHUNK_SIZE = 1024
+const MAX_RETRIES = 3
+
 var errorLog = log.New(os.Stderr, "ERROR: ", 0)
 
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s: %s (send|recv) <file>\n", os.Args[0], os.Args[0])
+	fmt.Fprintf(os.Stderr, "With -wormhole, send prints a code to type into recv. It is the default\n"+
+		"without -aes, -passphrase or a signaling key in the settings\n")
 	flag.PrintDefaults() 
 }
 
@@ -26,80 +33,127 @@ func main() {
 	var settingsPath string
 	var debug bool
 	var aes string
-
-	atf.SettingsFlag(&settingsPath)
-	atf.DebugFlag(&debug)
-	atf.AESFlag(&aes)
+	var passphrase bool
+	var wormhole bool
+	var code string
+	var showProgress bool
+
+	atf.SettingsFlag(flag.CommandLine, &settingsPath)
+	atf.DebugFlag(flag.CommandLine, &debug)
+	atf.AESFlag(flag.CommandLine, &aes)
+	atf.PassphraseFlag(flag.CommandLine, &passphrase)
+	atf.ProgressFlag(flag.CommandLine, &showProgress)
+	flag.BoolVar(&wormhole, "wormhole", false, "pair with the peer through a short one-off code")
+	flag.StringVar(&code, "code", "", "wormhole code to use (implies -wormhole)")
 
 	flag.Usage = Usage
 	flag.Parse()
 	
 	op := flag.Arg(0)
 	target := flag.Arg(1)
-	settings := new(dc.ConnectionSettings) 
 	atf.SetDebugMode(debug)
 
-	file, err := os.Open(settingsPath)
+	loaded, err := atf.LoadSettings(settingsPath)
 	if err != nil {
-		errorLog.Fatalf("Failed to read settings: %v", err)
-	}
-
-	defer file.Close()
-
-	// Read the file contents
-	bytes, err := io.ReadAll(file)
-	if err != nil {
-		errorLog.Fatalf("Failed to read file: %v", err)
-	}
-
-	if err := json.Unmarshal(bytes, settings); err != nil {
-		errorLog.Fatalf("Failed to unmarshal JSON: %v", err)
+		errorLog.Fatalf("%v", err)
 	}
+	settings := &loaded.ConnectionSettings
 
 	if op != "send" && op != "recv" { 
 		errorLog.Fatalf("Expected 'recv' or 'send', got %s", op)
 	}
 
-	log.Print("Opening connection")
-	conn, err := dc.FromSettings(settings)
-	defer conn.CloseAll()
+	// with nothing else to meet the peer, a one-off code is used
+	wormhole = wormhole || code != "" || aes == "" && !passphrase && settings.Key == ""
+	if wormhole {
+		if aes != "" || passphrase {
+			errorLog.Fatal("-wormhole cannot be combined with -aes or -passphrase")
+		}
+		switch {
+		case code != "":
+		case op == "send":
+			code, err = atf.GenerateCode()
+			if err != nil {
+				errorLog.Fatalf("Cannot generate a code: %v", err)
+			}
+			fmt.Fprintf(os.Stderr, "Wormhole code is: %s\n", code)
+			fmt.Fprintf(os.Stderr, "On the other computer, run: %s -wormhole recv <dir>\n", os.Args[0])
+		default:
+			code, err = promptCode()
+			if err != nil {
+				errorLog.Fatalf("Cannot read the code: %v", err)
+			}
+		}
+		var nameplate string
+		code, nameplate, err = atf.ParseCode(code)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		settings.Key = atf.WormholeRoom(nameplate)
+	}
 
-	var channel dc.IOChannel
-	if aes != "" {
-		file, err := os.Open(aes)
+	var cypher *dc.AESGCM
+	var config *atf.HandshakeConfig
+	if !wormhole {
+		// no folder to keep a salt in: use a fresh one for every transfer
+		secret, err := atf.MakeSecret(aes, passphrase, dc.CreateKey(atf.SaltSize))
 		if err != nil {
-			errorLog.Fatalf("Failed to open file: %v", err)
+			errorLog.Fatalf("Error while loading the encryption key: %v", err)
 		}
-		key, err := io.ReadAll(file)
+
+		identity, knownPeers, err := atf.LoadDevice(filepath.Dir(settingsPath))
 		if err != nil {
-			errorLog.Fatalf("Failed to read key file: %v", err)
+			errorLog.Fatalf("Error while loading the device identity: %v", err)
 		}
-		file.Close()
-		cypher, err := dc.NewAESGCM(key)
+		log.Printf("Device fingerprint: %s", identity.Fingerprint())
+		config = &atf.HandshakeConfig{
+			Secret:   secret,
+			Identity: identity,
+			Peers:    knownPeers,
+			PeerName: settings.Key,
+		}
+	}
+
+	log.Print("Opening connection")
+	// the receiver may take a while to type the code
+	conn, err := connect(settings, wormhole && op == "send")
+	if err != nil {
+		errorLog.Fatalf("Error initializing the connection: %v", err)
+	}
+	over := atf.WatchState(conn)
+	defer atf.CloseGracefully(conn, over)
+
+	log.Print("Opened")
+
+	if wormhole {
+		cypher, err = atf.Wormhole(conn, code, op == "send")
 		if err != nil {
-			errorLog.Fatalf("Error while creating AES cypher: %v", err)
+			atf.CloseGracefully(conn, over)
+			errorLog.Fatalf("Pairing failed: %v", err)
 		}
-		channel = dc.NewAESConnection(conn, cypher)
 	} else {
-		channel = conn
+		session, err := atf.Handshake(conn, config)
+		if err != nil {
+			atf.CloseGracefully(conn, over)
+			errorLog.Fatalf("Handshake failed: %v", err)
+		}
+		log.Printf("Authenticated peer %s", atf.Fingerprint(session.Peer))
+		cypher = session.Cypher
 	}
-
+	errChannel := make(chan error, 1)
 	go func() {
-		for {
-			log.Printf("state changed: %v \n", <-conn.State)
-		}
+		errorLog.Fatalf("Error: %v", <-errChannel)
 	}()
+	channel := atf.Secure(conn, cypher, errChannel)
 
-	log.Print("Opened")
-
-	if err != nil {
-		errorLog.Fatalf("Error initializing the connection: %v", err)
+	var progress *atf.Progress
+	if showProgress {
+		progress = atf.NewProgress(op, atf.NewProgressDisplay(os.Stderr).Update)
 	}
-	
 	if op == "recv" {
-		err = Receive(channel, target)
+		err = Receive(channel, target, progress)
 	} else {
-		err = Send(channel, target)
+		err = Send(channel, target, progress)
 	}
 
 	if err != nil {
@@ -107,14 +161,54 @@ func main() {
 	}
 }
 
-func Receive(c dc.IOChannel, basePath string) error {
+// Connects to the signaling room. If wait is set, keeps waiting for the
+// peer past the timeout of the signaling server.
+func connect(settings *dc.ConnectionSettings, wait bool) (*dc.Connection, error) {
+	for {
+		conn, err := dc.FromSettings(settings)
+		if err == nil || !wait || !TimedOut(err) {
+			return conn, err
+		}
+		log.Print("Still waiting for the receiver...")
+	}
+}
+
+// Reply of the signaling server when nobody joined the room in time,
+// as reported by directchan
+const SIGNALING_TIMEOUT = "Bad response: Fatal: timeout"
+
+// Tells whether connecting failed because the peer did not show up in
+// time, rather than because of a broken connection or a refused room
+func TimedOut(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return err.Error() == SIGNALING_TIMEOUT
+}
+
+// Asks the user for the wormhole code shown by the sender
+func promptCode() (string, error) {
+	fmt.Fprint(os.Stderr, "Enter wormhole code: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return line, nil
+}
+
+func Receive(c dc.IOChannel, basePath string, progress *atf.Progress) error {
 	info := new(atf.FileInfo)
 	err := json.Unmarshal(c.Recv(), info)
 	if err != nil {
 		return err
 	}
 
-	path := filepath.Join(basePath, info.Name)
+	path, err := atf.SafeJoin(basePath, info.Name)
+	if err != nil {
+		c.Send([]byte("KO"))
+		return err
+	}
 	log.Printf("Writing file to %s", path)
 
 	size := info.Size
@@ -128,47 +222,65 @@ func Receive(c dc.IOChannel, basePath string) error {
 		log.Printf("Created tmp tar in %s", tarPath)
 		file, err = os.Create(tarPath)
 	} else {
-		file, err = os.Create(path)
+		// content is moved to path only once verified
+		file, err = os.Create(atf.PartialName(path))
 	}
 
-	defer file.Close()
-
 	if err != nil {
+		c.Send([]byte("KO"))
 		return err
 	}
-	
-	received := 0
-	for {
-		chunk := c.Recv()
-		log.Printf("Received chunk of %3d bytes", len(chunk))
-		received += len(chunk)
+	defer file.Close()
 
-		_, err := file.Write(chunk)
-		if err != nil {
+	progress.Expect(1, size)
+	progress.Begin(info.Name)
+	for attempt := 0; ; attempt++ {
+		err = atf.RecvContent(c, progress.Writer(file), size)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, atf.ErrIntegrity) || attempt == MAX_RETRIES {
 			c.Send([]byte("KO"))
+			os.Remove(file.Name())
 			return err
 		}
-		
-		if int64(received) == size {
-			break
+		log.Printf("%v, retrying (%d/%d)", err, attempt+1, MAX_RETRIES)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := file.Truncate(0); err != nil {
+			return err
 		}
+		progress.Retry()
+		c.Send([]byte("RETRY"))
 	}
 
 	if info.IsDir {
 		log.Printf("Extracting tar to %s", path)
-		proc := exec.Command("tar", "-xf", tarPath, "-C", basePath)
-		if err := proc.Run(); err != nil {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := atf.ExtractTar(file, basePath); err != nil {
+			c.Send([]byte("KO"))
+			return err
+		}
+	} else {
+		file.Close()
+		if err := os.Rename(file.Name(), path); err != nil {
+			c.Send([]byte("KO"))
 			return err
 		}
 	}
 
 	c.Send([]byte("ACK"))
 	log.Printf("Sent ACK")
+	progress.End()
+	progress.Finish()
 	return nil
 }
 
 
-func Send(c dc.IOChannel, path string) error {
+func Send(c dc.IOChannel, path string, progress *atf.Progress) error {
 	osInfo, err := os.Stat(path)
 	if err != nil {
 		return err
@@ -214,23 +326,29 @@ func Send(c dc.IOChannel, path string) error {
 	}
 
 	c.Send(infoBytes)
-	buf := make([]byte, 1024)	
+	progress.Expect(1, info.Size)
+	progress.Begin(info.Name)
 	for {
-		n, err := file.Read(buf)
+		n, err := atf.SendContent(c, progress.Reader(file), CHUNK_SIZE)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
 			return err
 		}
-		log.Printf("Sent slice of %5d bytes", n)
-		chunk := slices.Clone(buf[:n])
-		c.Send(chunk)
-	}
-
-	if res := string(c.Recv()); res != "ACK" {
-		return fmt.Errorf("Expected ACK, got %s", res)
+		log.Printf("Sent %5d bytes", n)
+
+		switch res := string(c.Recv()); res {
+		case "ACK":
+			log.Printf("Received ACK")
+			progress.End()
+			progress.Finish()
+			return nil
+		case "RETRY":
+			log.Printf("Receiver asked to retry")
+			progress.Retry()
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Expected ACK, got %s", res)
+		}
 	}
-	log.Printf("Received ACK")
-	return nil
 }
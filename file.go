@@ -13,6 +13,17 @@ type FileInfo struct {
 	Mode     os.FileMode `json:"mode"`
 	ModTime  time.Time   `json:"mod_time"`
 	IsDir    bool        `json:"is_dir"`
+	Digest   string      `json:"digest,omitempty"` // hex SHA-256 of the content, if known
+	Remote   bool        `json:"remote,omitempty"` // only on the peer, outside the selective sync
+}
+
+// Tells whether i and o describe the same entry. A missing digest, as in
+// the databases written before digests were recorded, matches any.
+func (i FileInfo) Same(o FileInfo) bool {
+	if i.Digest == "" || o.Digest == "" {
+		i.Digest, o.Digest = "", ""
+	}
+	return i == o
 }
 
 func CloneInfo(info os.FileInfo) FileInfo {
@@ -40,6 +51,7 @@ func (i FileInfo) Hash() uint64 {
     } else {
         h.Write([]byte{0})
     }
+    h.Write([]byte(i.Digest))
 
     return h.Sum64()
 }
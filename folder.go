@@ -0,0 +1,170 @@
+package atf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Which changes a folder sends and receives
+type FolderMode string
+
+const (
+	SendReceive FolderMode = "send-receive"
+	SendOnly    FolderMode = "send-only"    // remote changes are ignored
+	ReceiveOnly FolderMode = "receive-only" // local changes are never sent
+)
+
+// Parses a folder mode, "" being SendReceive
+func ParseFolderMode(s string) (FolderMode, error) {
+	switch mode := FolderMode(s); mode {
+	case "":
+		return SendReceive, nil
+	case SendReceive, SendOnly, ReceiveOnly:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown folder mode %q: use %s, %s or %s", s, SendReceive, SendOnly, ReceiveOnly)
+}
+
+// How conflicts, files changed on both sides since the last sync, are
+// solved
+type ConflictStrategy string
+
+const (
+	KeepLatest ConflictStrategy = "latest" // the latest modification wins
+	KeepBoth   ConflictStrategy = "copy"   // likewise, keeping a conflict copy of the losing local version
+)
+
+// Parses a conflict strategy, "" being KeepLatest
+func ParseConflictStrategy(s string) (ConflictStrategy, error) {
+	switch strategy := ConflictStrategy(s); strategy {
+	case "":
+		return KeepLatest, nil
+	case KeepLatest, KeepBoth:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown conflict strategy %q: use %s or %s", s, KeepLatest, KeepBoth)
+}
+
+// Returns the name of the conflict copy of p made at t:
+// a/f.txt becomes a/f.conflict-20060102-150405.txt
+func ConflictCopyName(p string, t time.Time) string {
+	ext := filepath.Ext(p)
+	if ext == filepath.Base(p) { // dotfile
+		ext = ""
+	}
+	return strings.TrimSuffix(p, ext) + ".conflict-" + t.Format("20060102-150405") + ext
+}
+
+// Per folder settings, stored next to the folder database
+type FolderConfig struct {
+	Mode      FolderMode       `json:"mode,omitempty"`
+	Conflicts ConflictStrategy `json:"conflicts,omitempty"`
+
+	// only the subtrees in Select are synced
+	Selective bool     `json:"selective,omitempty"`
+	Select    []string `json:"select,omitempty"`
+
+	Trash Retention `json:"trash,omitzero"`
+	// days older versions of files are kept, 0 for DefaultVersionsDays
+	VersionsDays int `json:"versions_days,omitempty"`
+}
+
+// Loads the config stored in path; a missing one syncs the whole
+// folder both ways
+func LoadFolderConfig(path string) (*FolderConfig, error) {
+	config := &FolderConfig{Mode: SendReceive, Conflicts: KeepLatest}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid folder config %s: %w", path, err)
+	}
+	if config.Mode, err = ParseFolderMode(string(config.Mode)); err != nil {
+		return nil, fmt.Errorf("invalid folder config %s: %w", path, err)
+	}
+	if config.Conflicts, err = ParseConflictStrategy(string(config.Conflicts)); err != nil {
+		return nil, fmt.Errorf("invalid folder config %s: %w", path, err)
+	}
+	for i, s := range config.Select {
+		if config.Select[i], err = cleanSubtree(s); err != nil {
+			return nil, fmt.Errorf("invalid folder config %s: %w", path, err)
+		}
+	}
+	return config, nil
+}
+
+// Writes the config to path
+func (c *FolderConfig) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func cleanSubtree(p string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(p))
+	if !filepath.IsLocal(clean) || clean == "." {
+		return "", fmt.Errorf("%q is not a subfolder", p)
+	}
+	return clean, nil
+}
+
+// Adds the subtree p to the selection, making the sync selective
+func (c *FolderConfig) AddSelection(p string) error {
+	p, err := cleanSubtree(p)
+	if err != nil {
+		return err
+	}
+	c.Selective = true
+	if !slices.Contains(c.Select, p) {
+		c.Select = append(c.Select, p)
+	}
+	return nil
+}
+
+// Removes the subtree p from the selection
+func (c *FolderConfig) RemoveSelection(p string) error {
+	p, err := cleanSubtree(p)
+	if err != nil {
+		return err
+	}
+	if !c.Selective {
+		return errors.New("the whole folder is synced: add subfolders first")
+	}
+	i := slices.Index(c.Select, p)
+	if i < 0 {
+		return fmt.Errorf("%s is not selected", p)
+	}
+	c.Select = slices.Delete(c.Select, i, i+1)
+	return nil
+}
+
+// Tells whether p is synced: it is in a selected subtree, or it is a
+// directory holding one
+func (c *FolderConfig) Selected(p string) bool {
+	if !c.Selective {
+		return true
+	}
+	for _, s := range c.Select {
+		if p == s || within(p, s) || within(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells whether p is below dir
+func within(p, dir string) bool {
+	return strings.HasPrefix(p, dir+string(filepath.Separator))
+}
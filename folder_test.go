@@ -0,0 +1,78 @@
+package atf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFolderConfig(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_folder"})
+	os.MkdirAll(root, 0755)
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "config")
+
+	config, err := LoadFolderConfig(path)
+	if err != nil || config.Mode != SendReceive || config.Selective || !config.Selected("anything") {
+		t.Fatalf("A missing config must sync everything (%v)", err)
+	}
+	if err := config.RemoveSelection("a"); err == nil {
+		t.Errorf("Removed a subfolder from a full sync")
+	}
+	for _, p := range []string{"..", "../a", "/a", "."} {
+		if err := config.AddSelection(p); err == nil {
+			t.Errorf("Selected %s", p)
+		}
+	}
+
+	config.AddSelection("photos/2024/")
+	config.AddSelection("docs")
+	config.AddSelection("docs")
+	for p, selected := range map[string]bool{
+		"photos":          true,
+		"photos/2024":     true,
+		"photos/2024/a/b": true,
+		"photos/2023":     false,
+		"photos/2024b":    false,
+		"docs/x":          true,
+		"doc":             false,
+		"music":           false,
+	} {
+		if config.Selected(filepath.FromSlash(p)) != selected {
+			t.Errorf("%s: expected selected %v", p, selected)
+		}
+	}
+
+	if err := config.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadFolderConfig(path)
+	if err != nil || !reflect.DeepEqual(loaded, config) {
+		t.Errorf("Expected %+v, got %+v (%v)", config, loaded, err)
+	}
+
+	if err := loaded.RemoveSelection("docs"); err != nil || loaded.Selected("docs") {
+		t.Errorf("docs still selected (%v)", err)
+	}
+	if err := loaded.RemoveSelection("docs"); err == nil {
+		t.Errorf("Removed docs twice")
+	}
+
+	for _, invalid := range []string{
+		`{"selective": true, "select": ["../up"]}`,
+		`{"mode": "send-some"}`,
+	} {
+		os.WriteFile(path, []byte(invalid), 0644)
+		if _, err := LoadFolderConfig(path); err == nil {
+			t.Errorf("Loaded %s", invalid)
+		}
+	}
+	os.WriteFile(path, []byte(`{"mode": "receive-only"}`), 0644)
+	if config, err := LoadFolderConfig(path); err != nil || config.Mode != ReceiveOnly {
+		t.Errorf("Expected a receive-only folder, got %+v (%v)", config, err)
+	}
+	if mode, err := ParseFolderMode(""); err != nil || mode != SendReceive {
+		t.Errorf("Expected %s by default, got %s", SendReceive, mode)
+	}
+}
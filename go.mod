@@ -2,7 +2,13 @@ module github.com/leogem2003/allthoughtsfiles
 
 go 1.24.5
 
-require github.com/leogem2003/directchan v0.2.1
+require (
+	filippo.io/nistec v0.0.4
+	github.com/leogem2003/directchan v0.2.1
+	github.com/pion/webrtc/v4 v4.2.9
+	golang.org/x/crypto v0.48.0
+	golang.org/x/term v0.40.0
+)
 
 require (
 	github.com/google/uuid v1.6.0 // indirect
@@ -22,9 +28,7 @@ require (
 	github.com/pion/stun/v3 v3.1.1 // indirect
 	github.com/pion/transport/v4 v4.0.1 // indirect
 	github.com/pion/turn/v4 v4.1.4 // indirect
-	github.com/pion/webrtc/v4 v4.2.9 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
-	golang.org/x/crypto v0.48.0 // indirect
 	golang.org/x/net v0.50.0 // indirect
 	golang.org/x/sys v0.41.0 // indirect
 	golang.org/x/time v0.14.0 // indirect
@@ -0,0 +1,224 @@
+package atf
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Names of the files kept in the configuration directory
+const (
+	IdentityFile   = "identity.pem"
+	KnownPeersFile = "known_peers"
+)
+
+// Persistent Ed25519 key pair identifying a device
+type Identity struct {
+	Key ed25519.PrivateKey
+}
+
+func (id *Identity) Public() ed25519.PublicKey {
+	return id.Key.Public().(ed25519.PublicKey)
+}
+
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.Public())
+}
+
+// Returns the fingerprint of a device key, in the form SHA256:<base64>
+func Fingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Loads the identity stored in path, generating it if missing.
+// Creation is atomic: if two processes race, both end up with the
+// identity written first.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	id, err := loadIdentity(path)
+	if !os.IsNotExist(err) {
+		return id, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".identity")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	err = pem.Encode(tmp, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	return loadIdentity(path)
+}
+
+func loadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return &Identity{edKey}, nil
+}
+
+// Loads the device identity and the known peers kept in configDir,
+// creating the identity on first use.
+func LoadDevice(configDir string) (*Identity, *KnownPeers, error) {
+	id, err := LoadOrCreateIdentity(filepath.Join(configDir, IdentityFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	peers, err := LoadKnownPeers(filepath.Join(configDir, KnownPeersFile))
+	return id, peers, err
+}
+
+// Returned when a peer presents a key different from the pinned one
+var ErrPeerChanged = errors.New("peer identity has changed")
+
+// Fingerprints of the devices met so far, pinned on first use.
+// Stored one per line as "<fingerprint> <name>", where name is the
+// signaling key the device was met on.
+type KnownPeers struct {
+	Path  string
+	peers map[string]string
+	mu    sync.Mutex
+}
+
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	k := &KnownPeers{Path: path, peers: make(map[string]string)}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fp, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s: malformed line %q", path, line)
+		}
+		k.peers[name] = fp
+	}
+	return k, scanner.Err()
+}
+
+// Returns the pinned fingerprints, by name
+func (k *KnownPeers) All() map[string]string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	all := make(map[string]string, len(k.peers))
+	for name, fp := range k.peers {
+		all[name] = fp
+	}
+	return all
+}
+
+// Checks the key presented by the peer known as name.
+// Unknown peers are trusted and pinned; a known peer presenting a
+// different key is refused with ErrPeerChanged.
+func (k *KnownPeers) Verify(name string, pub ed25519.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	fp := Fingerprint(pub)
+	pinned, ok := k.peers[name]
+	if ok && pinned == fp {
+		return nil
+	}
+	if ok {
+		return fmt.Errorf(`%w
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+@     WARNING: REMOTE DEVICE IDENTIFICATION HAS CHANGED!    @
+@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@
+Someone could be impersonating the device you sync with on %q.
+Pinned fingerprint:    %s
+Presented fingerprint: %s
+If the device was legitimately reinstalled, remove its line from %s.`,
+			ErrPeerChanged, name, pinned, fp, k.Path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.Path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(k.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s %s\n", fp, name); err != nil {
+		return err
+	}
+	k.peers[name] = fp
+	return nil
+}
+
+// Removes the peer known as name, so that the next device met on it is
+// pinned again
+func (k *KnownPeers) Forget(name string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.peers[name]; !ok {
+		return fmt.Errorf("no known peer %q", name)
+	}
+	var b strings.Builder
+	for n, fp := range k.peers {
+		if n != name {
+			fmt.Fprintf(&b, "%s %s\n", fp, n)
+		}
+	}
+	tmp := k.Path + PartialSuffix
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, k.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	delete(k.peers, name)
+	return nil
+}
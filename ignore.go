@@ -0,0 +1,200 @@
+package atf
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the files listing the paths to keep out of synchronization.
+// They follow the syntax of gitignore and apply to the directory they
+// are in and to its subdirectories.
+const IgnoreFile = ".atfignore"
+
+// Single line of an ignore file
+type ignoreRule struct {
+	base     string   // slash separated directory of the ignore file, "" for the root
+	segments []string // pattern split on "/"
+	negate   bool
+	dirOnly  bool
+	anchored bool // matches from base rather than at any depth
+}
+
+// Rules collected from the ignore files of a tree
+type IgnoreRules struct {
+	rules []ignoreRule
+}
+
+// Collects the ignore files under root, before the scan: rules added
+// afterwards, like the ones of the settings, take precedence.
+// As in git, ignore files inside ignored directories are not read, nor
+// are the ones of MetaDir, which is never synced.
+func LoadIgnoreRules(root string) (*IgnoreRules, error) {
+	ignore := new(IgnoreRules)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		} else if rel == MetaDir || ignore.Ignored(rel, true) {
+			return filepath.SkipDir
+		}
+
+		file, err := os.Open(filepath.Join(p, IgnoreFile))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			ignore.Add(rel, scanner.Text())
+		}
+		return scanner.Err()
+	})
+	return ignore, err
+}
+
+// Adds the rule in line, read from the ignore file of directory base.
+// Blank lines and comments are skipped.
+func (ig *IgnoreRules) Add(base, line string) {
+	line = trimTrailingSpaces(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// a slash anywhere but at the end anchors the pattern
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	rule.segments = strings.Split(line, "/")
+	for i, s := range rule.segments {
+		// gitignore negates classes with "!", path.Match with "^"
+		rule.segments[i] = strings.ReplaceAll(s, "[!", "[^")
+	}
+	ig.rules = append(ig.rules, rule)
+}
+
+// Tells whether the slash or OS separated path rel, relative to the
+// root of the tree, is ignored. Paths inside an ignored directory are
+// ignored too, and cannot be re-included by a negated pattern.
+func (ig *IgnoreRules) Ignored(rel string, isDir bool) bool {
+	if ig == nil || len(ig.rules) == 0 {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for i := range len(rel) {
+		if rel[i] == '/' && ig.match(rel[:i], true) {
+			return true
+		}
+	}
+	return ig.match(rel, isDir)
+}
+
+// Returns a Policy dropping the ignored paths. Ignored directories are
+// skipped altogether, since nothing inside them can be re-included.
+func (ig *IgnoreRules) Policy() Policy {
+	return func(rel string, d fs.DirEntry) Decision {
+		if !ig.Ignored(rel, d.IsDir()) {
+			return Include
+		}
+		if d.IsDir() {
+			return SkipSubtree
+		}
+		return Exclude
+	}
+}
+
+// Evaluates the rules on rel alone: the last matching rule wins
+func (ig *IgnoreRules) match(rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range ig.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		sub := rel
+		if r.base != "" {
+			if !strings.HasPrefix(rel, r.base+"/") {
+				continue
+			}
+			sub = rel[len(r.base)+1:]
+		}
+		if r.matches(sub) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func (r *ignoreRule) matches(sub string) bool {
+	parts := strings.Split(sub, "/")
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], parts[len(parts)-1])
+		return ok
+	}
+	return matchSegments(r.segments, parts)
+}
+
+// Matches path segments against pattern segments, where "**" stands for
+// any number of directories; a trailing "**" needs at least one.
+func matchSegments(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(parts) > 0
+		}
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], parts[0])
+	return ok && matchSegments(pattern[1:], parts[1:])
+}
+
+// Removes trailing spaces, unless escaped with a backslash
+func trimTrailingSpaces(line string) string {
+	line = strings.TrimRight(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-2] + " "
+	}
+	return line
+}
@@ -0,0 +1,122 @@
+package atf
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	ignore := new(IgnoreRules)
+	for _, line := range []string{
+		"# comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"/root.txt",
+		"build/",
+		"docs/**/draft.md",
+		"cache/**",
+		"**/tmp",
+		`\#hash`,
+		"trailing   ",
+		"[!a]x",
+	} {
+		ignore.Add("", line)
+	}
+	ignore.Add("sub", "local.txt")
+	ignore.Add("sub", "/anchored")
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"deep/dir/a.log", false, true},
+		{"keep.log", false, false},
+		{"deep/keep.log", false, false},
+		{"root.txt", false, true},
+		{"sub/root.txt", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build", true, true},
+		{"src/build/out.o", false, true},
+		{"docs/draft.md", false, true},
+		{"docs/a/b/draft.md", false, true},
+		{"other/docs/draft.md", false, false},
+		{"cache", true, false},
+		{"cache/x/y", false, true},
+		{"tmp", true, true},
+		{"a/b/tmp", false, true},
+		{"#hash", false, true},
+		{"trailing", false, true},
+		{"bx", false, true},
+		{"ax", false, false},
+		{"sub/local.txt", false, true},
+		{"sub/x/local.txt", false, true},
+		{"local.txt", false, false},
+		{"sub/anchored", false, true},
+		{"sub/x/anchored", false, false},
+	}
+	for _, c := range cases {
+		if got := ignore.Ignored(c.path, c.isDir); got != c.ignored {
+			t.Errorf("%s (dir: %t): expected ignored=%t", c.path, c.isDir, c.ignored)
+		}
+	}
+}
+
+func TestIgnoreExcludedParent(t *testing.T) {
+	ignore := new(IgnoreRules)
+	ignore.Add("", "logs/")
+	ignore.Add("", "!logs/important.txt")
+	if !ignore.Ignored("logs/important.txt", false) {
+		t.Errorf("File re-included inside an ignored directory")
+	}
+}
+
+func TestIgnoreStats(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_ignore"})
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		IgnoreFile:             "*.tmp\nout/\n",
+		"a.txt":                "",
+		"a.tmp":                "",
+		"out/x.txt":            "",
+		"out/" + IgnoreFile:    "!x.txt\n",
+		"sub/" + IgnoreFile:    "*.txt\n!keep.txt\n",
+		"sub/drop.txt":         "",
+		"sub/keep.txt":         "",
+		"sub/nested/keep.txt":  "",
+		"sub/nested/other.tmp": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignore, err := LoadIgnoreRules(root)
+	if err != nil {
+		t.Fatalf("Cannot load rules: %v", err)
+	}
+	stats, err := CreateStatsWith(root, ignore.Policy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(stats))
+	for k := range stats {
+		got = append(got, filepath.ToSlash(k))
+	}
+	slices.Sort(got)
+	expected := []string{
+		IgnoreFile, "a.txt", "sub", "sub/" + IgnoreFile,
+		"sub/keep.txt", "sub/nested", "sub/nested/keep.txt",
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,103 @@
+package atf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	dc "github.com/leogem2003/directchan"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Size in bytes of the salts used for key derivation
+const SaltSize = 16
+
+// Environment variable read instead of prompting for a passphrase
+const PassphraseEnv = "ATF_PASSPHRASE"
+
+// scrypt cost parameters, as recommended for interactive logins
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Derives a 256 bit AES key from passphrase using scrypt
+func DeriveKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+}
+
+// Returns the salt shared by two peers: both salts, in a fixed order,
+// so that each side derives the same key.
+func CombineSalts(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	salt := make([]byte, 0, len(a)+len(b))
+	return append(append(salt, a...), b...)
+}
+
+// Reads the salt stored in path, creating a random one if missing
+func LoadOrCreateSalt(path string) ([]byte, error) {
+	salt, err := os.ReadFile(path)
+	if err == nil {
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	salt = dc.CreateKey(SaltSize)
+	return salt, os.WriteFile(path, salt, 0600)
+}
+
+// Reads a passphrase from the environment variable PassphraseEnv or,
+// if unset, from the terminal with echo disabled.
+func ReadPassphrase(prompt string) ([]byte, error) {
+	if env, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(env), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	var line []byte
+	var err error
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		line, err = term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+	} else {
+		line, err = readLine(os.Stdin)
+	}
+	if err != nil {
+		return nil, err
+	}
+	passphrase := bytes.TrimRight(line, "\r")
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// Reads r up to the end of the line, without the newline, one byte at a
+// time: nothing past it is consumed, so that r can be read again later.
+// A last line without a newline is returned as it is.
+func readLine(r io.Reader) ([]byte, error) {
+	line := make([]byte, 0)
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return line, nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
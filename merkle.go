@@ -0,0 +1,246 @@
+package atf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+// Merkle tree of a folder: every directory is hashed from the names and
+// hashes of its children, so that two peers can find where their trees
+// differ by comparing hashes from the root down.
+// Files are hashed from their mode, size and digest: modification times
+// differ between peers even for identical content, so they are only used
+// for files without a digest.
+type MerkleTree struct {
+	dirs map[string]map[string]MerkleChild // children of each directory, "" for the root
+	root []byte
+}
+
+// Entry of a directory in a MerkleTree
+type MerkleChild struct {
+	Hash  []byte `json:"h"`
+	IsDir bool   `json:"d,omitempty"`
+}
+
+// Builds the Merkle tree of stats
+func BuildMerkle(stats Stats) *MerkleTree {
+	t := &MerkleTree{dirs: map[string]map[string]MerkleChild{"": {}}}
+	for p, info := range stats {
+		t.addDir(parentDir(p))
+		if info.IsDir {
+			t.addDir(p)
+			continue
+		}
+		t.dirs[parentDir(p)][filepath.Base(p)] = MerkleChild{Hash: leafHash(info)}
+	}
+
+	// children before parents: deeper directories first
+	dirs := slices.Collect(maps.Keys(t.dirs))
+	slices.SortFunc(dirs, func(a, b string) int {
+		return depth(b) - depth(a)
+	})
+	for _, dir := range dirs {
+		h := dirHash(t.dirs[dir])
+		if dir == "" {
+			t.root = h
+			continue
+		}
+		t.dirs[parentDir(dir)][filepath.Base(dir)] = MerkleChild{Hash: h, IsDir: true}
+	}
+	return t
+}
+
+// Hash of the whole tree
+func (t *MerkleTree) Root() []byte {
+	return t.root
+}
+
+// Returns the children of dir, by name; nil if dir is not a directory
+func (t *MerkleTree) Children(dir string) map[string]MerkleChild {
+	return t.dirs[dir]
+}
+
+func (t *MerkleTree) addDir(dir string) {
+	for dir != "" {
+		if _, ok := t.dirs[dir]; ok {
+			return
+		}
+		t.dirs[dir] = make(map[string]MerkleChild)
+		dir = parentDir(dir)
+	}
+}
+
+func leafHash(info FileInfo) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint32(info.Mode))
+	binary.Write(h, binary.BigEndian, info.Size)
+	if info.Digest != "" {
+		h.Write([]byte(info.Digest))
+	} else {
+		binary.Write(h, binary.BigEndian, info.ModTime.UnixNano())
+	}
+	return h.Sum(nil)
+}
+
+func dirHash(children map[string]MerkleChild) []byte {
+	h := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(children)) {
+		child := children[name]
+		binary.Write(h, binary.BigEndian, uint64(len(name)))
+		h.Write([]byte(name))
+		if child.IsDir {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+		h.Write(child.Hash)
+	}
+	return h.Sum(nil)
+}
+
+// Directory containing p, "" for the top level
+func parentDir(p string) string {
+	dir := filepath.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+func depth(p string) int {
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, string(filepath.Separator)) + 1
+}
+
+// Where two Merkle trees differ
+type MerkleDiff struct {
+	dirs     map[string]bool // directories on both sides, with different content
+	subtrees map[string]bool // paths differing with everything below them
+}
+
+// Tells whether the trees are identical
+func (d *MerkleDiff) Equal() bool {
+	return len(d.dirs) == 0 && len(d.subtrees) == 0
+}
+
+// Tells whether p, or the subtree holding it, differs between the trees
+func (d *MerkleDiff) Differs(p string) bool {
+	if d.dirs[p] {
+		return true
+	}
+	for ; p != ""; p = parentDir(p) {
+		if d.subtrees[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// Directory listing exchanged by CompareMerkle
+type merkleNode struct {
+	Dir      string                 `json:"dir"`
+	Children map[string]MerkleChild `json:"children"`
+}
+
+// Finds where t and the tree of the peer differ, descending level by
+// level only into the directories whose hashes differ. Both peers must
+// call it at the same time: every step is symmetric.
+// Identical trees cost a single exchange of root hashes.
+func CompareMerkle(c dc.IOChannel, t *MerkleTree) (*MerkleDiff, error) {
+	diff := &MerkleDiff{dirs: make(map[string]bool), subtrees: make(map[string]bool)}
+	c.Send(t.root)
+	if bytes.Equal(c.Recv(), t.root) {
+		return diff, nil
+	}
+	diff.dirs[""] = true
+
+	frontier := []string{""}
+	for len(frontier) > 0 {
+		remote, err := exchangeNodes(c, t, frontier)
+		if err != nil {
+			return nil, err
+		}
+		next := make([]string, 0)
+		for _, dir := range frontier {
+			local, peer := t.dirs[dir], remote[dir]
+			names := make(map[string]bool, len(local)+len(peer))
+			for name := range local {
+				names[name] = true
+			}
+			for name := range peer {
+				names[name] = true
+			}
+			for name := range names {
+				l, inLocal := local[name]
+				r, inPeer := peer[name]
+				if inLocal && inPeer && l.IsDir == r.IsDir && bytes.Equal(l.Hash, r.Hash) {
+					continue
+				}
+				p := filepath.Join(dir, name)
+				if inLocal && inPeer && l.IsDir && r.IsDir {
+					diff.dirs[p] = true
+					next = append(next, p)
+				} else {
+					diff.subtrees[p] = true
+				}
+			}
+		}
+		slices.SortFunc(next, ComparePaths)
+		frontier = next
+	}
+	return diff, nil
+}
+
+// Sends the listings of dirs and receives the ones of the peer
+func exchangeNodes(c dc.IOChannel, t *MerkleTree, dirs []string) (map[string]map[string]MerkleChild, error) {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendBatches(c, func(yield func(merkleNode) bool) {
+			for _, dir := range dirs {
+				if !yield(merkleNode{dir, t.dirs[dir]}) {
+					return
+				}
+			}
+		})
+	}()
+
+	remote := make(map[string]map[string]MerkleChild, len(dirs))
+	wanted := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		wanted[dir] = true
+	}
+	var recvErr error
+	var nodes iter.Seq2[merkleNode, error] = RecvBatches[merkleNode](c)
+	for node, err := range nodes {
+		if err != nil {
+			recvErr = err
+			break
+		}
+		if !wanted[node.Dir] {
+			recvErr = fmt.Errorf("peer sent unrequested directory %q", node.Dir)
+			continue
+		}
+		for name := range node.Children {
+			if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+				recvErr = errors.New("peer sent an invalid name in its tree")
+			}
+		}
+		remote[node.Dir] = node.Children
+	}
+	if err := <-sent; recvErr == nil {
+		recvErr = err
+	}
+	return remote, recvErr
+}
@@ -0,0 +1,112 @@
+package atf
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+func merkleStats() Stats {
+	stats := Stats{
+		"a":   {Name: "a", IsDir: true},
+		"b":   {Name: "b", IsDir: true},
+		"top": {Name: "top", Size: 3, Digest: "top"},
+	}
+	for i := range 50 {
+		for _, dir := range []string{"a", "b"} {
+			name := fmt.Sprintf("f%d", i)
+			stats[filepath.Join(dir, name)] = FileInfo{Name: name, Size: int64(i), Digest: name}
+		}
+	}
+	return stats
+}
+
+// Runs CompareMerkle on both ends, counting the messages sent by the first
+func compareTrees(t *testing.T, s1, s2 Stats) (*MerkleDiff, int) {
+	p1, p2 := MakePipes(1024)
+	done := make(chan *MerkleDiff, 1)
+	go func() {
+		diff, err := CompareMerkle(p2, BuildMerkle(s2))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- diff
+	}()
+	counting := &countingChannel{IOChannel: p1}
+	diff, err := CompareMerkle(counting, BuildMerkle(s1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := <-done
+	if other == nil || diff.Equal() != other.Equal() {
+		t.Fatalf("Peers disagree")
+	}
+	return diff, counting.sent
+}
+
+func TestMerkle(t *testing.T) {
+	s1, s2 := merkleStats(), merkleStats()
+	if !bytes.Equal(BuildMerkle(s1).Root(), BuildMerkle(s2).Root()) {
+		t.Fatal("Equal stats with different roots")
+	}
+
+	// modification times do not matter when digests are known
+	info := s2["a/f1"]
+	info.ModTime = time.Now()
+	s2["a/f1"] = info
+	diff, sent := compareTrees(t, s1, s2)
+	if !diff.Equal() || sent != 1 {
+		t.Errorf("Expected equal trees after one message, got %v after %d", diff.Equal(), sent)
+	}
+
+	info.Digest = "changed"
+	s2["a/f1"] = info
+	delete(s2, "b/f2")
+	s2["c/d/e"] = FileInfo{Name: "e"}
+	diff, sent = compareTrees(t, s1, s2)
+	for p, differs := range map[string]bool{
+		"a/f1":  true,
+		"a/f2":  false,
+		"b/f2":  true,
+		"b/f3":  false,
+		"c":     true,
+		"c/d/e": true,
+		"top":   false,
+		"a":     true,
+	} {
+		if diff.Differs(filepath.FromSlash(p)) != differs {
+			t.Errorf("%s: expected differs %v", p, differs)
+		}
+	}
+	// root hash, then one listing of each level with its terminator
+	if sent != 5 {
+		t.Errorf("Expected 5 messages, got %d", sent)
+	}
+
+	// a file replacing a directory
+	s3 := merkleStats()
+	s3["a"] = FileInfo{Name: "a"}
+	for p := range s3 {
+		if filepath.Dir(p) == "a" {
+			delete(s3, p)
+		}
+	}
+	diff, _ = compareTrees(t, s1, s3)
+	if !diff.Differs(filepath.Join("a", "f7")) || diff.Differs("b") {
+		t.Errorf("Type change not detected")
+	}
+}
+
+type countingChannel struct {
+	dc.IOChannel
+	sent int
+}
+
+func (c *countingChannel) Send(data []byte) {
+	c.sent++
+	c.IOChannel.Send(data)
+}
@@ -0,0 +1,252 @@
+package atf
+
+import (
+	"encoding/binary"
+	"maps"
+	"slices"
+	"sync"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+// Kinds of the frames of a Mux
+const (
+	muxData byte = iota
+	muxClose
+	muxCredit // the payload is the number of messages read, big endian
+)
+
+// Messages a channel may have in flight: a sender waits for the peer to
+// read them before sending more
+const MuxWindow = 32
+
+// Channels the peer may send on before they are opened locally: the
+// peer is not read any further until one of them is opened
+const MaxPendingChannels = 64
+
+// Multiplexes named channels over a single one, so that several
+// sessions run concurrently on one connection. A frame holds its kind,
+// the length of the channel name, the name and the payload.
+//
+// Every channel has a window of MuxWindow messages, granted back by the
+// receiver as it reads them: a session that is slow to read only slows
+// down its sender, and never holds more than a window in memory.
+type Mux struct {
+	conn     dc.IOChannel
+	mu       sync.Mutex
+	accepted *sync.Cond // signaled when a pending channel is opened
+	channels map[string]*MuxChannel
+	closed   map[string]bool // messages to these are dropped
+	pending  int             // channels not opened locally yet
+	done     bool            // the underlying channel is closed
+}
+
+// Channel of a Mux. Recv returns nil once it is closed, on either side,
+// and the messages received before are read.
+type MuxChannel struct {
+	mux      *Mux
+	name     string
+	mu       sync.Mutex
+	ready    *sync.Cond // signaled on messages, credits and closing
+	queue    [][]byte
+	opened   bool // opened locally
+	credit   int  // messages that can be sent
+	consumed int  // messages read and not granted back yet
+	closed   bool
+}
+
+// Starts demultiplexing conn, until it returns nil
+func NewMux(conn dc.IOChannel) *Mux {
+	m := &Mux{
+		conn:     conn,
+		channels: make(map[string]*MuxChannel),
+		closed:   make(map[string]bool),
+	}
+	m.accepted = sync.NewCond(&m.mu)
+	go m.demux()
+	return m
+}
+
+func (m *Mux) demux() {
+	for {
+		frame := m.conn.Recv()
+		if frame == nil {
+			break
+		}
+		if len(frame) < 2 || len(frame) < 2+int(frame[1]) {
+			continue
+		}
+		name := string(frame[2 : 2+frame[1]])
+		payload := frame[2+frame[1]:]
+		m.mu.Lock()
+		_, known := m.channels[name]
+		for !known && !m.closed[name] && m.pending >= MaxPendingChannels {
+			m.accepted.Wait()
+			_, known = m.channels[name]
+		}
+		c := m.channel(name)
+		if c != nil && !known {
+			m.pending++
+		}
+		m.mu.Unlock()
+		if c == nil {
+			continue
+		}
+		switch frame[0] {
+		case muxData:
+			c.push(payload)
+		case muxClose:
+			c.close()
+		case muxCredit:
+			if len(payload) == 4 {
+				c.grant(int(binary.BigEndian.Uint32(payload)))
+			}
+		}
+	}
+
+	m.mu.Lock()
+	m.done = true
+	channels := slices.Collect(maps.Values(m.channels))
+	m.mu.Unlock()
+	for _, c := range channels {
+		c.close()
+	}
+}
+
+// Returns the channel name, created if missing, nil if it was closed.
+// m.mu must be held.
+func (m *Mux) channel(name string) *MuxChannel {
+	if m.closed[name] {
+		return nil
+	}
+	c, ok := m.channels[name]
+	if !ok {
+		c = newMuxChannel(m, name, m.done)
+		m.channels[name] = c
+	}
+	return c
+}
+
+func newMuxChannel(m *Mux, name string, closed bool) *MuxChannel {
+	c := &MuxChannel{mux: m, name: name, credit: MuxWindow, closed: closed}
+	c.ready = sync.NewCond(&c.mu)
+	return c
+}
+
+// Opens the channel name, receiving the messages the peer sent on it.
+// Names are at most 255 bytes long, and a closed channel cannot be
+// opened again.
+func (m *Mux) Open(name string) *MuxChannel {
+	if len(name) > 255 {
+		panic("mux channel name too long: " + name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, known := m.channels[name]
+	c := m.channel(name)
+	if c == nil {
+		return newMuxChannel(m, name, true)
+	}
+	if known && !c.opened {
+		m.pending--
+		m.accepted.Broadcast()
+	}
+	c.opened = true
+	return c
+}
+
+func (c *MuxChannel) frame(kind byte, payload []byte) []byte {
+	return slices.Concat([]byte{kind, byte(len(c.name))}, []byte(c.name), payload)
+}
+
+// Sends b, waiting for the peer to read enough of the messages in
+// flight. Messages sent on a closed channel are dropped.
+func (c *MuxChannel) Send(b []byte) {
+	c.mu.Lock()
+	for c.credit == 0 && !c.closed {
+		c.ready.Wait()
+	}
+	closed := c.closed
+	c.credit--
+	c.mu.Unlock()
+	if !closed {
+		c.mux.conn.Send(c.frame(muxData, b))
+	}
+}
+
+func (c *MuxChannel) Recv() []byte {
+	c.mu.Lock()
+	for len(c.queue) == 0 && !c.closed {
+		c.ready.Wait()
+	}
+	if len(c.queue) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	b := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	// the window is granted back by halves, not message by message
+	c.consumed++
+	granted := 0
+	if c.consumed >= MuxWindow/2 && !c.closed {
+		granted, c.consumed = c.consumed, 0
+	}
+	c.mu.Unlock()
+
+	if granted > 0 {
+		c.mux.conn.Send(c.frame(muxCredit, binary.BigEndian.AppendUint32(nil, uint32(granted))))
+	}
+	return b
+}
+
+func (c *MuxChannel) push(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if len(c.queue) >= MuxWindow {
+		// the peer ignores the window: the session is broken
+		c.closed = true
+		c.ready.Broadcast()
+		return
+	}
+	c.queue = append(c.queue, b)
+	c.ready.Broadcast()
+}
+
+func (c *MuxChannel) grant(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credit = min(c.credit+n, MuxWindow)
+	c.ready.Broadcast()
+}
+
+// Marks the channel closed, returning whether it was open
+func (c *MuxChannel) close() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wasOpen := !c.closed
+	c.closed = true
+	c.ready.Broadcast()
+	return wasOpen
+}
+
+// Closes the channel on both sides: pending and later Recv calls return
+// nil once the queued messages are read
+func (c *MuxChannel) Close() {
+	m := c.mux
+	m.mu.Lock()
+	// the peer is told once, even if the channel broke on its own
+	first := m.channels[c.name] == c
+	if first {
+		delete(m.channels, c.name)
+		m.closed[c.name] = true
+	}
+	done := m.done
+	m.mu.Unlock()
+	if (c.close() || first) && !done {
+		m.conn.Send(c.frame(muxClose, nil))
+	}
+}
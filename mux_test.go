@@ -0,0 +1,128 @@
+package atf
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMux(t *testing.T) {
+	p1, p2 := MakePipes(1)
+	m1, m2 := NewMux(p1), NewMux(p2)
+
+	// messages sent before the peer opens the channel are kept
+	m1.Open("early").Send([]byte("hello"))
+
+	var wg sync.WaitGroup
+	for i := range 5 {
+		name := fmt.Sprintf("folder%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c := m1.Open(name)
+			for j := range 100 {
+				c.Send([]byte(fmt.Sprintf("%s-%d", name, j)))
+			}
+			if string(c.Recv()) != "done" {
+				t.Errorf("%s: no answer", name)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			c := m2.Open(name)
+			for j := range 100 {
+				if got, expected := string(c.Recv()), fmt.Sprintf("%s-%d", name, j); got != expected {
+					t.Errorf("Expected %s, got %s", expected, got)
+				}
+			}
+			c.Send([]byte("done"))
+		}()
+	}
+	// an unread channel does not block the others
+	for range 10 {
+		m1.Open("unread").Send([]byte("ignored"))
+	}
+	wg.Wait()
+	if got := string(m2.Open("early").Recv()); got != "hello" {
+		t.Errorf("Expected hello, got %s", got)
+	}
+
+	// closing is seen by the peer after the queued messages
+	c1, c2 := m1.Open("closing"), m2.Open("closing")
+	c1.Send([]byte("last"))
+	c1.Close()
+	if got := string(c2.Recv()); got != "last" {
+		t.Errorf("Expected last, got %s", got)
+	}
+	if got := c2.Recv(); got != nil {
+		t.Errorf("Received %q from a closed channel", got)
+	}
+	c2.Close()
+	if got := m1.Open("closing").Recv(); got != nil {
+		t.Errorf("Reopened a closed channel")
+	}
+
+	// closing the connection closes every channel
+	pending := m2.Open("pending")
+	close(p2.Out)
+	if got := pending.Recv(); got != nil {
+		t.Errorf("Received %q after the connection closed", got)
+	}
+	if got := m2.Open("late").Recv(); got != nil {
+		t.Errorf("Opened a channel after the connection closed")
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	p1, p2 := MakePipes(1)
+	m1, m2 := NewMux(p1), NewMux(p2)
+
+	// a sender waits for the messages in flight to be read
+	var sent atomic.Int32
+	go func() {
+		c := m1.Open("slow")
+		for i := range MuxWindow * 3 {
+			c.Send([]byte{byte(i)})
+			sent.Add(1)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if n := sent.Load(); n != MuxWindow {
+		t.Errorf("Sent %d messages without reads, expected %d", n, MuxWindow)
+	}
+	c := m2.Open("slow")
+	for i := range MuxWindow * 3 {
+		if got := c.Recv(); len(got) != 1 || got[0] != byte(i) {
+			t.Fatalf("Expected message %d, got %v", i, got)
+		}
+	}
+
+	// channels the peer sends on are only held up to a limit
+	raw, other := MakePipes(MaxPendingChannels + 2)
+	m := NewMux(other)
+	frame := func(name string) []byte {
+		return slices.Concat([]byte{muxData, byte(len(name))}, []byte(name), []byte("x"))
+	}
+	for i := range MaxPendingChannels {
+		raw.Send(frame(fmt.Sprint("pending", i)))
+	}
+	raw.Send(frame("extra"))
+	target := m.Open("target")
+	raw.Send(frame("target"))
+	received := make(chan []byte, 1)
+	go func() { received <- target.Recv() }()
+	select {
+	case <-received:
+		t.Fatal("Read past the limit of pending channels")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := string(m.Open("pending0").Recv()); got != "x" {
+		t.Errorf("Expected x, got %s", got)
+	}
+	if got := string(<-received); got != "x" {
+		t.Errorf("Expected x, got %s", got)
+	}
+}
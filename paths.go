@@ -0,0 +1,193 @@
+package atf
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returned when a path received from a peer would resolve outside
+// of the directory it is meant to be written into.
+var ErrUnsafePath = errors.New("unsafe path")
+
+func unsafePath(name, reason string) error {
+	return fmt.Errorf("%w %q: %s", ErrUnsafePath, name, reason)
+}
+
+// Reports whether p is root or one of its descendants.
+// Both paths are expected to be clean.
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// Checks the syntax of a relative path supplied by a peer:
+// it must be non empty, relative, free of NUL bytes and of ".." components.
+func CheckRelPath(name string) error {
+	if name == "" {
+		return unsafePath(name, "empty path")
+	}
+	if strings.ContainsRune(name, 0) {
+		return unsafePath(name, "contains NUL byte")
+	}
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") {
+		return unsafePath(name, "absolute path")
+	}
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == '\\' || r == os.PathSeparator
+	})
+	for _, p := range parts {
+		if p == ".." {
+			return unsafePath(name, "parent directory reference")
+		}
+	}
+	return nil
+}
+
+// Joins name, a path supplied by a peer, to root after checking that
+// the result stays inside root.
+// Besides the checks of CheckRelPath, every existing component of the
+// joined path is inspected: symlinks are allowed only if they resolve
+// inside root.
+func SafeJoin(root, name string) (string, error) {
+	if err := CheckRelPath(name); err != nil {
+		return "", err
+	}
+
+	root = filepath.Clean(root)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(root, name)
+	rel, err := filepath.Rel(root, path)
+	if err != nil || !isWithin(root, path) || rel == "." {
+		return "", unsafePath(name, "outside of root")
+	}
+
+	cur := root
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			break // the rest will be created
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(cur)
+		if err != nil {
+			return "", unsafePath(name, "dangling symlink")
+		}
+		if !isWithin(realRoot, resolved) {
+			return "", unsafePath(name, "symlink escapes root")
+		}
+	}
+	return path, nil
+}
+
+// Extracts the tar archive read from r into dest.
+// Every entry is validated with SafeJoin; symlinks and hard links
+// must point inside dest, other special files are refused.
+// Extraction stops at the first offending entry.
+func ExtractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir && filepath.Clean(hdr.Name) == "." {
+			continue
+		}
+
+		path, err := SafeJoin(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode().Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := extractFile(tr, path, mode, hdr.Size); err != nil {
+				return err
+			}
+			os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+		case tar.TypeSymlink:
+			if err := extractSymlink(dest, path, hdr.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := SafeJoin(dest, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(target, path); err != nil {
+				return err
+			}
+		default:
+			return unsafePath(hdr.Name, "unsupported entry type")
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, mode os.FileMode, size int64) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(file, r, size)
+	return err
+}
+
+func extractSymlink(dest, path, target string) error {
+	if target == "" || filepath.IsAbs(target) || strings.ContainsRune(target, 0) {
+		return unsafePath(target, "bad symlink target")
+	}
+	if !isWithin(filepath.Clean(dest), filepath.Join(filepath.Dir(path), target)) {
+		return unsafePath(target, "symlink escapes root")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+
+	// lexical checks can be fooled by symlinks already in the tree
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil && !isWithin(realDest, resolved) {
+		os.Remove(path)
+		return unsafePath(target, "symlink escapes root")
+	}
+	return nil
+}
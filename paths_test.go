@@ -0,0 +1,127 @@
+package atf
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeTar(t *testing.T, headers []tar.Header) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, h := range headers {
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatalf("Cannot write tar header: %v", err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tw.Write(make([]byte, h.Size))
+		}
+	}
+	tw.Close()
+	return buf
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_safejoin"})
+	outside := GetTmpName([]string{"atf", "test_safejoin_out"})
+	MakePlayground(root, []string{"a/f.txt"})
+	os.MkdirAll(outside, 0755)
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(outside)
+
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink("a", filepath.Join(root, "inside"))
+	os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "dangling"))
+
+	allowed := []string{"a/f.txt", "a/new.txt", "b/c/d", "inside/f.txt"}
+	for _, name := range allowed {
+		if _, err := SafeJoin(root, name); err != nil {
+			t.Errorf("%q: unexpected error %v", name, err)
+		}
+	}
+
+	rejected := []string{
+		"",
+		".",
+		"..",
+		"../x",
+		"a/../../x",
+		"a/..",
+		"/etc/passwd",
+		"a\x00b",
+		"escape",
+		"escape/f.txt",
+		"dangling",
+	}
+	for _, name := range rejected {
+		if _, err := SafeJoin(root, name); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%q: expected unsafe path error, got %v", name, err)
+		}
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	outside := GetTmpName([]string{"atf", "test_tar_out"})
+	os.MkdirAll(outside, 0755)
+	defer os.RemoveAll(outside)
+
+	attacks := map[string][]tar.Header{
+		"parent": {
+			{Name: "../evil.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"nested parent": {
+			{Name: "a/../../evil.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"absolute": {
+			{Name: filepath.Join(outside, "evil.txt"), Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"absolute symlink": {
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: outside},
+		},
+		"relative symlink": {
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		},
+		"symlink chain": {
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "s/.."},
+		},
+		"hard link": {
+			{Name: "l", Typeflag: tar.TypeLink, Linkname: "../evil.txt"},
+		},
+		"device": {
+			{Name: "dev", Typeflag: tar.TypeChar, Mode: 0644},
+		},
+	}
+
+	for name, headers := range attacks {
+		dest := GetTmpName([]string{"atf", "test_tar"})
+		os.MkdirAll(dest, 0755)
+		err := ExtractTar(makeTar(t, headers), dest)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s: expected unsafe path error, got %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "evil.txt")); err == nil {
+			t.Errorf("%s: file written outside of destination", name)
+		}
+		os.RemoveAll(dest)
+	}
+
+	dest := GetTmpName([]string{"atf", "test_tar"})
+	os.MkdirAll(dest, 0755)
+	defer os.RemoveAll(dest)
+	legit := []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "a/f.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		{Name: "b/link", Typeflag: tar.TypeSymlink, Linkname: "../a/f.txt"},
+	}
+	if err := ExtractTar(makeTar(t, legit), dest); err != nil {
+		t.Fatalf("Unexpected error while extracting: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "b", "link")); err != nil {
+		t.Errorf("Symlink not extracted: %v", err)
+	}
+}
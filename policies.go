@@ -1,8 +1,11 @@
 package atf 
 import (
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 )
 var slashdot = string(os.PathSeparator)+"."
 
@@ -15,9 +18,7 @@ func IgnoreDot(path string) bool {
 }
 
 func IgnoreDotFolders(path string) bool {
-	info, _ := os.Stat(path)
-
-	if info.IsDir() {
+	if isDir(path) {
 		return !strings.Contains(filepath.Clean(path), slashdot)
 	}
 
@@ -25,9 +26,7 @@ func IgnoreDotFolders(path string) bool {
 }
 
 func IgnoreDotFiles(path string) bool {
-	info, _ := os.Stat(path)
-
-	if info.IsDir() {
+	if isDir(path) {
 		return true
 	}
 
@@ -36,12 +35,173 @@ func IgnoreDotFiles(path string) bool {
 
 func MakeIgnoreSuffix(suffix string) func(string) bool {
 	return func(path string) bool {
-		info, _ := os.Stat(path)
-
-		if info.IsDir() {
+		if isDir(path) {
 			return true
 		}
 		return !strings.HasSuffix(path, suffix)
 	}
 }
 
+// Outcome of a Policy on a path
+type Decision int
+
+const (
+	Include     Decision = iota // keep the path
+	Exclude                     // drop the path, but look inside it if a directory
+	SkipSubtree                 // drop the path and, if a directory, everything below it
+)
+
+// Selects the paths of a scan. rel is the path relative to the scanned
+// directory, d its entry.
+type Policy func(rel string, d fs.DirEntry) Decision
+
+// Policy keeping every path
+func IncludeAll(_ string, _ fs.DirEntry) Decision {
+	return Include
+}
+
+// Turns a predicate on the full path, as taken by CreateStats, into a
+// Policy for the tree rooted at root.
+func FromPredicate(root string, pred func(string) bool) Policy {
+	return func(rel string, _ fs.DirEntry) Decision {
+		if pred(filepath.Join(root, rel)) {
+			return Include
+		}
+		return Exclude
+	}
+}
+
+// Keeps the paths kept by all of policies.
+// A subtree skipped by any of them is skipped.
+func And(policies ...Policy) Policy {
+	return func(rel string, d fs.DirEntry) Decision {
+		decision := Include
+		for _, p := range policies {
+			decision = max(decision, p(rel, d))
+			if decision == SkipSubtree {
+				break
+			}
+		}
+		return decision
+	}
+}
+
+// Keeps the paths kept by any of policies.
+// A subtree is skipped only if all of them skip it.
+func Or(policies ...Policy) Policy {
+	return func(rel string, d fs.DirEntry) Decision {
+		decision := SkipSubtree
+		for _, p := range policies {
+			decision = min(decision, p(rel, d))
+			if decision == Include {
+				break
+			}
+		}
+		return decision
+	}
+}
+
+// Keeps the paths dropped by p.
+// A skipped directory is kept and its content is evaluated again.
+func Not(p Policy) Policy {
+	return func(rel string, d fs.DirEntry) Decision {
+		if p(rel, d) == Include {
+			return Exclude
+		}
+		return Include
+	}
+}
+
+// Keeps the paths matching pattern, with the syntax of filepath.Match.
+// Patterns without a separator are matched against the base name,
+// the others against the whole relative path.
+func Glob(pattern string) Policy {
+	matchBase := !strings.ContainsRune(pattern, os.PathSeparator)
+	return func(rel string, _ fs.DirEntry) Decision {
+		name := rel
+		if matchBase {
+			name = filepath.Base(rel)
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return Include
+		}
+		return Exclude
+	}
+}
+
+// Keeps the paths whose slash separated relative path matches re
+func Regex(re *regexp.Regexp) Policy {
+	return func(rel string, _ fs.DirEntry) Decision {
+		if re.MatchString(filepath.ToSlash(rel)) {
+			return Include
+		}
+		return Exclude
+	}
+}
+
+// Keeps the files whose size is between min and max bytes, included.
+// A negative max means no upper bound. Directories are kept.
+func SizeRange(min, max int64) Policy {
+	return filePolicy(func(info fs.FileInfo) bool {
+		return info.Size() >= min && (max < 0 || info.Size() <= max)
+	})
+}
+
+// Keeps the files last modified between min and max ago, included.
+// A zero max means no upper bound. Directories are kept.
+func AgeRange(min, max time.Duration) Policy {
+	return filePolicy(func(info fs.FileInfo) bool {
+		age := time.Since(info.ModTime())
+		return age >= min && (max == 0 || age <= max)
+	})
+}
+
+// Drops the files whose name ends with suffix
+func ExcludeSuffix(suffix string) Policy {
+	return func(rel string, d fs.DirEntry) Decision {
+		if !d.IsDir() && strings.HasSuffix(rel, suffix) {
+			return Exclude
+		}
+		return Include
+	}
+}
+
+// Drops dot files and skips dot directories with their content
+func ExcludeHidden(_ string, d fs.DirEntry) Decision {
+	if !strings.HasPrefix(d.Name(), ".") {
+		return Include
+	}
+	if d.IsDir() {
+		return SkipSubtree
+	}
+	return Exclude
+}
+
+// Skips the MetaDir of the folder, holding the trash, with its content
+func ExcludeMeta(rel string, _ fs.DirEntry) Decision {
+	if rel == MetaDir {
+		return SkipSubtree
+	}
+	return Include
+}
+
+// Applies keep to the info of files, keeping directories.
+// Files that vanished since they were listed are dropped.
+func filePolicy(keep func(fs.FileInfo) bool) Policy {
+	return func(_ string, d fs.DirEntry) Decision {
+		if d.IsDir() {
+			return Include
+		}
+		info, err := d.Info()
+		if err != nil || !keep(info) {
+			return Exclude
+		}
+		return Include
+	}
+}
+
+// Tells whether path is a directory, false if it cannot be stat'ed
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -1,7 +1,10 @@
 package atf
 
 import (
+	"io/fs"
+	"regexp"
 	"slices"
+	"time"
 	"testing"
 	"os"
 	"path/filepath"
@@ -76,3 +79,73 @@ func TestExcludeDots(t *testing.T) {
 	testPolicy(IgnoreDotFiles, tmpTot, tmpExcFiles, "IgnoreDotFiles", t)
 	testPolicy(MakeIgnoreSuffix("file.txt"), tmpTot, tmpExcSuffix, "ExcludeSuffix", t)
 }
+
+func TestPolicyCombinators(t *testing.T) {
+	tmp := GetTmpName([]string{"atf", "test_policy_combinators"})
+	defer os.RemoveAll(tmp)
+	files := map[string]int{
+		"a.txt":            10,
+		"b.log":            2000,
+		"docs/c.txt":       100,
+		"docs/big.txt":     5000,
+		".hidden/d.txt":    10,
+		".hidden/deep/e.x": 10,
+	}
+	for name, size := range files {
+		p := filepath.Join(tmp, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(filepath.Join(tmp, "b.log"), old, old)
+
+	scan := func(policy Policy) []string {
+		stats, err := CreateStatsWith(tmp, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, 0, len(stats))
+		for k := range stats {
+			keys = append(keys, filepath.ToSlash(k))
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	check := func(info string, policy Policy, expected ...string) {
+		if got := scan(policy); !slices.Equal(got, expected) {
+			t.Errorf("%s: expected %v, got %v", info, expected, got)
+		}
+	}
+
+	visited := make([]string, 0)
+	spy := func(rel string, d fs.DirEntry) Decision {
+		visited = append(visited, filepath.ToSlash(rel))
+		return ExcludeHidden(rel, d)
+	}
+	check("ExcludeHidden", spy, "a.txt", "b.log", "docs", "docs/big.txt", "docs/c.txt")
+	if slices.Contains(visited, ".hidden/d.txt") {
+		t.Errorf("Skipped directory was descended into: %v", visited)
+	}
+
+	check("Glob", Glob("*.txt"), ".hidden/d.txt", "a.txt", "docs/big.txt", "docs/c.txt")
+	check("Glob path", Glob(filepath.Join("docs", "*")), "docs/big.txt", "docs/c.txt")
+	check("Regex", Regex(regexp.MustCompile(`^docs/`)), "docs/big.txt", "docs/c.txt")
+	check("SizeRange", And(ExcludeHidden, SizeRange(50, 4000)), "b.log", "docs", "docs/c.txt")
+	check("AgeRange", And(ExcludeHidden, Glob("*.*"), AgeRange(24*time.Hour, 0)), "b.log")
+	check("Or", And(ExcludeHidden, Or(Glob("*.log"), Glob("c.txt"))), "b.log", "docs/c.txt")
+	check("Not", And(ExcludeHidden, Not(Glob("*.txt"))), "b.log", "docs")
+	check("Not skipped", Not(ExcludeHidden), ".hidden")
+	check("FromPredicate", FromPredicate(tmp, IgnoreDot), "a.txt", "b.log", "docs", "docs/big.txt", "docs/c.txt")
+}
+
+func TestPoliciesMissingPath(t *testing.T) {
+	missing := filepath.Join(GetTmpName([]string{"atf", "test_missing"}), "gone.txt")
+	// must not panic on paths that vanished
+	IgnoreDotFolders(missing)
+	IgnoreDotFiles(missing)
+	if MakeIgnoreSuffix(".txt")(missing) {
+		t.Errorf("Suffix not excluded for a missing path")
+	}
+}
@@ -0,0 +1,210 @@
+package atf
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"os"
+	"path/filepath"
+	"slices"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+const tagKeyInfo = "allthoughtsfile path tags"
+
+// Length in bytes of a path tag, before hex encoding
+const TagSize = 16
+
+var ErrTagMismatch = errors.New("private mode mismatch: peers use different folder secrets")
+
+// Hides paths and metadata behind keyed hashes of a folder secret, like
+// StatsToHash does with plain FNV: peers holding the same secret agree on
+// the tags, anybody else learns nothing from them.
+// A nil Tagger leaves paths in the clear.
+type Tagger struct {
+	key []byte
+}
+
+// Reads the folder secret stored in path. Any content will do, as long
+// as the peers share it: it is never used as a key directly.
+func LoadFolderSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty folder secret " + path)
+	}
+	return secret, nil
+}
+
+// Builds the Tagger of the folder secret
+func NewTagger(secret []byte) (*Tagger, error) {
+	key, err := hkdf.Key(sha256.New, secret, nil, tagKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &Tagger{key}, nil
+}
+
+func (t *Tagger) mac(domain string) hash.Hash {
+	h := hmac.New(sha256.New, t.key)
+	h.Write([]byte(domain))
+	h.Write([]byte{0})
+	return h
+}
+
+// Returns the tag of p, the same on every OS
+func (t *Tagger) Path(p string) string {
+	if t == nil {
+		return p
+	}
+	h := t.mac("path")
+	h.Write([]byte(filepath.ToSlash(p)))
+	return hex.EncodeToString(h.Sum(nil)[:TagSize])
+}
+
+// Returns the tags of paths
+func (t *Tagger) Paths(paths []string) []string {
+	if t == nil {
+		return paths
+	}
+	tags := make([]string, len(paths))
+	for i, p := range paths {
+		tags[i] = t.Path(p)
+	}
+	return tags
+}
+
+// Returns the tag of the content of an entry. Directories are tagged by
+// their type only, as their content is made of other entries.
+func (t *Tagger) Info(info FileInfo) string {
+	h := t.mac("info")
+	if info.IsDir {
+		h.Write([]byte{1})
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	h.Write([]byte{0})
+	binary.Write(h, binary.BigEndian, uint32(info.Mode))
+	binary.Write(h, binary.BigEndian, info.Size)
+	if info.Digest != "" {
+		h.Write([]byte(info.Digest))
+	} else {
+		binary.Write(h, binary.BigEndian, info.ModTime.UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns s keyed by path tags, with the content of every entry hidden
+// in its Digest: no other metadata is kept.
+// Tags are flat, so that the peer does not learn the shape of the tree
+// either: the Merkle tree of the result has a single directory, and a
+// comparison that finds a difference exchanges every tag.
+func (t *Tagger) Stats(s Stats) Stats {
+	if t == nil {
+		return s
+	}
+	tagged := make(Stats, len(s))
+	for p, info := range s {
+		tagged[t.Path(p)] = FileInfo{Digest: t.Info(info)}
+	}
+	return tagged
+}
+
+// Returns the modification times of s keyed by path tags, to solve
+// conflicts: they are only sent for the entries both peers changed.
+func (t *Tagger) ModTimes(s Stats) Stats {
+	if t == nil {
+		return s
+	}
+	times := make(Stats, len(s))
+	for p, info := range s {
+		times[t.Path(p)] = FileInfo{ModTime: info.ModTime}
+	}
+	return times
+}
+
+// Tells whether the peer uses the same folder secret, or neither uses one.
+// Both peers must call it at the same time.
+func CheckTagger(c dc.IOChannel, t *Tagger) error {
+	check := []byte("clear")
+	if t != nil {
+		check = t.mac("check").Sum(nil)
+	}
+	c.Send(check)
+	remote := c.Recv()
+	switch {
+	case hmac.Equal(check, remote):
+		return nil
+	case t == nil || string(remote) == "clear":
+		return errors.New("private mode mismatch: only one peer uses a folder secret")
+	}
+	return ErrTagMismatch
+}
+
+type revealedPath struct {
+	Tag  string `json:"tag"`
+	Path string `json:"path"`
+}
+
+// Asks the peer for the paths behind the tags in wanted, and reveals the
+// ones it asks for among revealable, a map from tags to paths.
+// Returns the paths received in ComparePaths order, checked against their
+// tags; tags the peer does not reveal are left out.
+// Both peers must call it at the same time.
+// With a nil Tagger, tags are paths and nothing is exchanged.
+func RevealPaths(c dc.IOChannel, t *Tagger, revealable map[string]string, wanted []string) ([]string, error) {
+	if t == nil {
+		return wanted, nil
+	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendBatches(c, slices.Values(wanted))
+	}()
+	asked, err := RecvPaths(c)
+	if sendErr := <-sent; err == nil {
+		err = sendErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		sent <- SendBatches(c, func(yield func(revealedPath) bool) {
+			for _, tag := range asked {
+				p, ok := revealable[tag]
+				if ok && !yield(revealedPath{tag, filepath.ToSlash(p)}) {
+					return
+				}
+			}
+		})
+	}()
+	revealed, err := recvList[revealedPath](c)
+	if sendErr := <-sent; err == nil {
+		err = sendErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	isWanted := make(map[string]bool, len(wanted))
+	for _, tag := range wanted {
+		isWanted[tag] = true
+	}
+	paths := make([]string, 0, len(revealed))
+	for _, r := range revealed {
+		p := filepath.FromSlash(r.Path)
+		if !isWanted[r.Tag] || t.Path(p) != r.Tag {
+			return nil, errors.New("peer revealed a path not matching its tag")
+		}
+		delete(isWanted, r.Tag)
+		paths = append(paths, p)
+	}
+	slices.SortFunc(paths, ComparePaths)
+	return paths, nil
+}
@@ -0,0 +1,131 @@
+package atf
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTagger(t *testing.T, secret string) *Tagger {
+	tagger, err := NewTagger([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tagger
+}
+
+func TestTagger(t *testing.T) {
+	t1, t2 := newTagger(t, "secret"), newTagger(t, "other")
+	p := filepath.Join("dir", "file.txt")
+	if t1.Path(p) != newTagger(t, "secret").Path(p) {
+		t.Errorf("Tags are not deterministic")
+	}
+	if t1.Path(p) == t2.Path(p) || strings.Contains(t1.Path(p), "file") {
+		t.Errorf("Tag %s does not hide the path", t1.Path(p))
+	}
+	if (*Tagger)(nil).Path(p) != p {
+		t.Errorf("A nil Tagger must leave paths in the clear")
+	}
+
+	stats := merkleStats()
+	for p, info := range stats {
+		info.ModTime = time.Unix(1700000000, 0)
+		stats[p] = info
+	}
+	tagged := t1.Stats(stats)
+	if len(tagged) != len(stats) {
+		t.Fatalf("Expected %d tags, got %d", len(stats), len(tagged))
+	}
+	for _, info := range tagged {
+		if info.Name != "" || info.Size != 0 || !info.ModTime.IsZero() {
+			t.Errorf("Tagged stats leak metadata: %+v", info)
+		}
+	}
+	// the same content has the same tags, whatever the peer
+	if !bytes.Equal(BuildMerkle(tagged).Root(), BuildMerkle(t1.Stats(merkleStats())).Root()) {
+		t.Errorf("Equal stats with different tagged roots")
+	}
+	// times are kept apart, for the conflicts only
+	if info := t1.ModTimes(stats)[t1.Path("top")]; !info.ModTime.Equal(time.Unix(1700000000, 0)) || info.Digest != "" {
+		t.Errorf("Unexpected tagged time %+v", info)
+	}
+}
+
+func TestLoadFolderSecret(t *testing.T) {
+	dir := t.TempDir()
+	// any length will do, unlike an AES key
+	path := filepath.Join(dir, "secret")
+	os.WriteFile(path, []byte("correct horse battery staple\n"), 0600)
+	if secret, err := LoadFolderSecret(path); err != nil || string(secret) != "correct horse battery staple\n" {
+		t.Errorf("Unexpected secret %q: %v", secret, err)
+	}
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, nil, 0600)
+	if _, err := LoadFolderSecret(empty); err == nil {
+		t.Errorf("Empty secret accepted")
+	}
+}
+
+func TestCheckTagger(t *testing.T) {
+	for _, test := range []struct {
+		t1, t2 *Tagger
+		ok     bool
+	}{
+		{nil, nil, true},
+		{newTagger(t, "secret"), newTagger(t, "secret"), true},
+		{newTagger(t, "secret"), newTagger(t, "other"), false},
+		{newTagger(t, "secret"), nil, false},
+	} {
+		p1, p2 := MakePipes(1)
+		done := make(chan error, 1)
+		go func() { done <- CheckTagger(p2, test.t2) }()
+		err1, err2 := CheckTagger(p1, test.t1), <-done
+		if (err1 == nil) != test.ok || (err2 == nil) != test.ok {
+			t.Errorf("Expected ok %v, got %v and %v", test.ok, err1, err2)
+		}
+	}
+}
+
+func TestRevealPaths(t *testing.T) {
+	tagger := newTagger(t, "secret")
+	a, b, c := filepath.Join("a", "x"), "b", "c"
+	revealable := map[string]string{tagger.Path(a): a, tagger.Path(b): b}
+
+	p1, p2 := MakePipes(16)
+	done := make(chan []string, 1)
+	go func() {
+		// the peer reveals nothing and asks for all three
+		paths, err := RevealPaths(p2, tagger, nil, tagger.Paths([]string{a, b, c}))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- paths
+	}()
+	paths, err := RevealPaths(p1, tagger, revealable, nil)
+	if err != nil || len(paths) != 0 {
+		t.Errorf("Expected nothing revealed, got %v %v", paths, err)
+	}
+	got := <-done
+	slices.Sort(got)
+	if !slices.Equal(got, []string{a, b}) {
+		t.Errorf("Expected %v revealed, got %v", []string{a, b}, got)
+	}
+
+	// a path not matching its tag is refused
+	go func() {
+		RevealPaths(p2, tagger, map[string]string{tagger.Path(b): c}, nil)
+	}()
+	if _, err := RevealPaths(p1, tagger, nil, []string{tagger.Path(b)}); err == nil {
+		t.Errorf("Forged path accepted")
+	}
+
+	// without a Tagger nothing is exchanged
+	paths, err = RevealPaths(p1, nil, nil, []string{a})
+	if err != nil || !slices.Equal(paths, []string{a}) || len(p1.Out) != 0 {
+		t.Errorf("Unexpected exchange in clear mode")
+	}
+}
@@ -0,0 +1,328 @@
+package atf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State of a transfer, reported on every change of its Progress
+type ProgressEvent struct {
+	Label     string
+	Files     int // expected, 0 if unknown
+	FilesDone int
+	Bytes     int64 // expected, 0 if unknown
+	BytesDone int64
+	Current   string        // file being transferred
+	Rate      float64       // bytes per second since the first file
+	ETA       time.Duration // 0 if unknown
+	Finished  bool
+}
+
+// Receives the events of a Progress. It is called synchronously, by
+// the goroutine doing the transfer.
+type ProgressFunc func(ProgressEvent)
+
+// Tracks a transfer, reporting its progress to a listener.
+// A nil Progress tracks nothing.
+type Progress struct {
+	mu       sync.Mutex
+	event    ProgressEvent
+	fileDone int64 // bytes of the current file
+	start    time.Time
+	listener ProgressFunc
+}
+
+func NewProgress(label string, listener ProgressFunc) *Progress {
+	return &Progress{event: ProgressEvent{Label: label}, listener: listener}
+}
+
+// Reports the event, p.mu must be held
+func (p *Progress) emit() {
+	e := &p.event
+	if elapsed := time.Since(p.start).Seconds(); !p.start.IsZero() && elapsed > 0 {
+		e.Rate = float64(e.BytesDone) / elapsed
+	}
+	e.ETA = 0
+	if e.Rate > 0 && e.Bytes > e.BytesDone {
+		e.ETA = time.Duration(float64(e.Bytes-e.BytesDone) / e.Rate * float64(time.Second))
+	}
+	if p.listener != nil {
+		p.listener(*e)
+	}
+}
+
+// Adds files and bytes to the expected ones, negative to drop them
+func (p *Progress) Expect(files int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.event.Files += files
+	p.event.Bytes += bytes
+	p.emit()
+}
+
+// Starts the transfer of a file
+func (p *Progress) Begin(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	p.event.Current = name
+	p.fileDone = 0
+	p.emit()
+}
+
+// Counts n bytes of the current file
+func (p *Progress) Add(n int) {
+	if p == nil || n == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fileDone += int64(n)
+	p.event.BytesDone += int64(n)
+	p.emit()
+}
+
+// Discards the bytes counted for the current file, which is sent again
+func (p *Progress) Retry() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.event.BytesDone -= p.fileDone
+	p.fileDone = 0
+	p.emit()
+}
+
+// Ends the transfer of the current file
+func (p *Progress) End() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.event.FilesDone++
+	p.event.Current = ""
+	p.fileDone = 0
+	p.emit()
+}
+
+// Ends the transfer
+func (p *Progress) Finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.event.Current = ""
+	p.event.Finished = true
+	p.emit()
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(n)
+	return n, err
+}
+
+// Counts the bytes read from r
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return progressReader{r, p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *Progress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.Add(n)
+	return n, err
+}
+
+// Counts the bytes written to w
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return progressWriter{w, p}
+}
+
+// Time between the lines printed for a transfer when the output is not
+// a terminal
+const ProgressInterval = 5 * time.Second
+
+// Time between two redraws of the terminal display
+const progressRedraw = 100 * time.Millisecond
+
+// Longest name of the current file shown
+const progressNameWidth = 32
+
+// Shows the progress of transfers, one line each. On a terminal the
+// lines are redrawn in place, otherwise a line is printed when a
+// transfer starts and ends, and every ProgressInterval in between.
+// Transfers that never started a file are not shown.
+type ProgressDisplay struct {
+	mu       sync.Mutex
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+	labels   []string // in order of appearance
+	events   map[string]ProgressEvent
+	printed  map[string]time.Time // last line printed of each label, if not a tty
+	drawn    int                  // lines drawn by the last redraw
+	redrawn  time.Time
+}
+
+// Shows progress on out, redrawing in place if it is a terminal
+func NewProgressDisplay(out *os.File) *ProgressDisplay {
+	info, err := out.Stat()
+	tty := err == nil && info.Mode()&os.ModeCharDevice != 0
+	return newProgressDisplay(out, tty, ProgressInterval)
+}
+
+func newProgressDisplay(out io.Writer, tty bool, interval time.Duration) *ProgressDisplay {
+	return &ProgressDisplay{
+		out:      out,
+		tty:      tty,
+		interval: interval,
+		events:   make(map[string]ProgressEvent),
+		printed:  make(map[string]time.Time),
+	}
+}
+
+// Records e and refreshes the display. It is a ProgressFunc, safe to
+// share between concurrent transfers.
+func (d *ProgressDisplay) Update(e ProgressEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.events[e.Label]; !ok {
+		if e.Current == "" && e.FilesDone == 0 {
+			return
+		}
+		d.labels = append(d.labels, e.Label)
+	}
+	d.events[e.Label] = e
+
+	now := time.Now()
+	if d.tty {
+		if e.Finished || now.Sub(d.redrawn) >= progressRedraw {
+			d.redraw()
+			d.redrawn = now
+		}
+		return
+	}
+	last, ok := d.printed[e.Label]
+	if !ok || e.Finished || now.Sub(last) >= d.interval {
+		fmt.Fprintln(d.out, FormatProgress(e))
+		d.printed[e.Label] = now
+	}
+}
+
+// Draws the lines again over the previous ones, d.mu must be held
+func (d *ProgressDisplay) redraw() {
+	b := new(strings.Builder)
+	if d.drawn > 0 {
+		fmt.Fprintf(b, "\x1b[%dA", d.drawn)
+	}
+	for _, label := range d.labels {
+		fmt.Fprintf(b, "\r\x1b[K%s\n", FormatProgress(d.events[label]))
+	}
+	d.drawn = len(d.labels)
+	io.WriteString(d.out, b.String())
+}
+
+// Formats e on one line:
+//
+//	docs: receiving  [#####---------------]   30%  3/10 files  1.2 MiB/4.0 MiB  512.0 KiB/s  ETA 0:05  a/b.txt
+func FormatProgress(e ProgressEvent) string {
+	parts := []string{e.Label}
+	switch {
+	case e.Finished:
+		parts = append(parts, fmt.Sprintf("done: %s files, %s", ratio(e.FilesDone, e.Files), FormatBytes(e.BytesDone)))
+	case e.Bytes > 0:
+		done := min(float64(e.BytesDone)/float64(e.Bytes), 1)
+		parts = append(parts,
+			progressBar(done, 20),
+			fmt.Sprintf("%3.0f%%", done*100),
+			ratio(e.FilesDone, e.Files)+" files",
+			FormatBytes(e.BytesDone)+"/"+FormatBytes(e.Bytes),
+		)
+	default:
+		parts = append(parts, ratio(e.FilesDone, e.Files)+" files", FormatBytes(e.BytesDone))
+	}
+	if e.Rate > 0 {
+		parts = append(parts, FormatBytes(int64(e.Rate))+"/s")
+	}
+	if e.ETA > 0 && !e.Finished {
+		parts = append(parts, "ETA "+formatETA(e.ETA))
+	}
+	if e.Current != "" {
+		parts = append(parts, shorten(e.Current, progressNameWidth))
+	}
+	return strings.Join(parts, "  ")
+}
+
+func ratio(done, total int) string {
+	if total > 0 {
+		return fmt.Sprintf("%d/%d", done, total)
+	}
+	return fmt.Sprint(done)
+}
+
+func progressBar(done float64, width int) string {
+	full := int(done * float64(width))
+	return "[" + strings.Repeat("#", full) + strings.Repeat("-", width-full) + "]"
+}
+
+func formatETA(d time.Duration) string {
+	s := int(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// Keeps the end of name, the most telling part of a path
+func shorten(name string, width int) string {
+	runes := []rune(name)
+	if len(runes) <= width {
+		return name
+	}
+	return "..." + string(runes[len(runes)-width+3:])
+}
+
+// Formats a size in bytes with a binary unit: 1536 is "1.5 KiB"
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 5 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[exp])
+}
@@ -0,0 +1,88 @@
+package atf
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	events := make([]ProgressEvent, 0)
+	p := NewProgress("docs", func(e ProgressEvent) { events = append(events, e) })
+	p.Expect(2, 300)
+
+	p.Begin("a")
+	io.Copy(p.Writer(io.Discard), bytes.NewReader(make([]byte, 50)))
+	p.Retry()
+	io.Copy(io.Discard, p.Reader(bytes.NewReader(make([]byte, 100))))
+	p.End()
+	// the second file turns out larger than announced
+	p.Expect(0, 100)
+	p.Begin("b")
+	p.Add(150)
+	last := events[len(events)-1]
+	if last.Current != "b" || last.FilesDone != 1 || last.BytesDone != 250 || last.Bytes != 400 {
+		t.Errorf("Unexpected event %+v", last)
+	}
+	if last.Rate <= 0 || last.ETA <= 0 {
+		t.Errorf("Missing rate or ETA: %+v", last)
+	}
+	p.Add(150)
+	p.End()
+	p.Finish()
+	last = events[len(events)-1]
+	if !last.Finished || last.FilesDone != 2 || last.BytesDone != 400 || last.ETA != 0 {
+		t.Errorf("Unexpected final event %+v", last)
+	}
+
+	// a nil Progress tracks nothing
+	var none *Progress
+	none.Begin("a")
+	none.Add(10)
+	if w := none.Writer(io.Discard); w != io.Discard {
+		t.Errorf("Writer wrapped by a nil Progress")
+	}
+}
+
+func TestProgressDisplay(t *testing.T) {
+	out := new(bytes.Buffer)
+	d := newProgressDisplay(out, false, time.Hour)
+	// a transfer with nothing to send is not shown
+	d.Update(ProgressEvent{Label: "idle", Finished: true})
+	d.Update(ProgressEvent{Label: "docs", Files: 2, Bytes: 2048, Current: "a"})
+	d.Update(ProgressEvent{Label: "docs", Files: 2, Bytes: 2048, BytesDone: 1024, Current: "a"})
+	d.Update(ProgressEvent{Label: "docs", Files: 2, FilesDone: 2, Bytes: 2048, BytesDone: 2048, Finished: true})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "docs  [----") || lines[1] != "docs  done: 2/2 files, 2.0 KiB" {
+		t.Errorf("Unexpected lines:\n%s", out)
+	}
+
+	out.Reset()
+	d = newProgressDisplay(out, true, time.Hour)
+	d.Update(ProgressEvent{Label: "a", Current: "x"})
+	d.Update(ProgressEvent{Label: "b", FilesDone: 1, Finished: true})
+	if !strings.Contains(out.String(), "\x1b[1A\r\x1b[Ka  0 files  0 B  x\n\r\x1b[Kb  done: 1 files, 0 B\n") {
+		t.Errorf("Lines not redrawn: %q", out)
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	e := ProgressEvent{
+		Label: "docs: receiving", Files: 10, FilesDone: 3, Bytes: 4 << 20, BytesDone: 1258291,
+		Rate: 512 << 10, ETA: 5 * time.Second, Current: "a/b.txt",
+	}
+	expected := "docs: receiving  [#####---------------]   30%  3/10 files  1.2 MiB/4.0 MiB  512.0 KiB/s  ETA 0:05  a/b.txt"
+	if line := FormatProgress(e); line != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, line)
+	}
+	if name := shorten(strings.Repeat("d/", 20)+"f", 10); name != "...d/d/d/f" {
+		t.Errorf("Unexpected short name %s", name)
+	}
+	for n, expected := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 3 << 30: "3.0 GiB"} {
+		if s := FormatBytes(n); s != expected {
+			t.Errorf("%d: expected %s, got %s", n, expected, s)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package atf
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Scans the tree rooted at root in fsys like CreateStatsFS, with up to
+// workers directories read at the same time. A non positive workers
+// uses one per CPU.
+// The result is the same as the one of CreateStatsFS; on error, the
+// first one met is returned and the scan stops.
+func CreateStatsParallel(fsys fs.FS, root string, policy Policy, workers int) (Stats, error) {
+	clone := func(_, _ string, info fs.FileInfo) (FileInfo, error) {
+		return CloneInfo(info), nil
+	}
+	return scanParallel(fsys, root, policy, workers, clone)
+}
+
+// Runs a parallel scan, turning the info of the path p, with key rel,
+// into a stats entry with clone. clone is called by the workers.
+func scanParallel(
+	fsys fs.FS,
+	root string,
+	policy Policy,
+	workers int,
+	clone func(p, rel string, info fs.FileInfo) (FileInfo, error),
+) (Stats, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	root = path.Clean(root)
+	info, err := fs.Stat(fsys, root)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(Stats)
+	if !info.IsDir() {
+		return stats, nil
+	}
+
+	s := &scanner{
+		fsys:   fsys,
+		root:   root,
+		policy: policy,
+		clone:  clone,
+		stats:  stats,
+		dirs:   []string{root},
+	}
+	s.cond = sync.NewCond(&s.mu)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work()
+		}()
+	}
+	wg.Wait()
+	return stats, s.err
+}
+
+// State shared by the workers of a parallel scan
+type scanner struct {
+	fsys   fs.FS
+	root   string
+	policy Policy
+	clone  func(p, rel string, info fs.FileInfo) (FileInfo, error)
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	dirs   []string // directories left to read
+	active int      // directories being read
+	stats  Stats
+	err    error
+}
+
+// Reads directories until none is left, or an error occurs
+func (s *scanner) work() {
+	for {
+		s.mu.Lock()
+		for len(s.dirs) == 0 && s.active > 0 && s.err == nil {
+			s.cond.Wait()
+		}
+		if len(s.dirs) == 0 || s.err != nil {
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+		dir := s.dirs[len(s.dirs)-1]
+		s.dirs = s.dirs[:len(s.dirs)-1]
+		s.active++
+		s.mu.Unlock()
+
+		found, subdirs, err := s.readDir(dir)
+
+		s.mu.Lock()
+		s.active--
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		for k, v := range found {
+			s.stats[k] = v
+		}
+		s.dirs = append(s.dirs, subdirs...)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// Returns the entries of dir selected by the policy and the
+// subdirectories to descend into
+func (s *scanner) readDir(dir string) (Stats, []string, error) {
+	entries, err := fs.ReadDir(s.fsys, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	found := make(Stats, len(entries))
+	subdirs := make([]string, 0)
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		rel := p
+		if s.root != "." {
+			rel = p[len(s.root)+1:]
+		}
+		rel = filepath.FromSlash(rel)
+
+		decision := s.policy(rel, entry)
+		if decision == SkipSubtree {
+			continue
+		}
+		if entry.IsDir() {
+			subdirs = append(subdirs, p)
+		}
+		if decision == Exclude {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, nil, err
+		}
+		found[rel], err = s.clone(p, rel, info)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return found, subdirs, nil
+}
@@ -0,0 +1,137 @@
+package atf
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// Writes a tree of width directories, each holding width files and
+// width subdirectories, depth levels deep
+func makeTree(tb testing.TB, root string, width, depth int) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	for i := range width {
+		name := filepath.Join(root, fmt.Sprintf("f%d.txt", i))
+		if err := os.WriteFile(name, []byte(name), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		if depth > 0 {
+			makeTree(tb, filepath.Join(root, fmt.Sprintf("d%d", i)), width, depth-1)
+		}
+	}
+	os.Mkdir(filepath.Join(root, ".hidden"), 0755)
+	os.WriteFile(filepath.Join(root, ".hidden", "f.txt"), nil, 0644)
+}
+
+func TestCreateStatsParallel(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_parallel"})
+	defer os.RemoveAll(root)
+	makeTree(t, root, 4, 3)
+	fsys := os.DirFS(root)
+
+	policies := map[string]Policy{
+		"all":    IncludeAll,
+		"hidden": ExcludeHidden,
+		"glob":   Glob("*.txt"),
+	}
+	for name, policy := range policies {
+		serial, err := CreateStatsFS(fsys, ".", policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{0, 1, 3, 16} {
+			parallel, err := CreateStatsParallel(fsys, ".", policy, workers)
+			if err != nil {
+				t.Errorf("%s, %d workers: unexpected error %v", name, workers, err)
+			}
+			if !reflect.DeepEqual(serial, parallel) {
+				t.Errorf("%s, %d workers: %d entries, expected %d",
+					name, workers, len(parallel), len(serial))
+			}
+		}
+	}
+
+	sub, _ := CreateStatsFS(fsys, "d1/", IncludeAll)
+	if parallel, _ := CreateStatsParallel(fsys, "d1/", IncludeAll, 4); !reflect.DeepEqual(sub, parallel) {
+		t.Errorf("Subtree scans differ")
+	}
+}
+
+var errBroken = errors.New("broken directory")
+
+// fstest.MapFS failing to list one directory
+type brokenFS struct {
+	fstest.MapFS
+	broken string
+}
+
+func (f brokenFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == f.broken {
+		return nil, errBroken
+	}
+	return f.MapFS.ReadDir(name)
+}
+
+func TestCreateStatsErrors(t *testing.T) {
+	fsys := brokenFS{fstest.MapFS{
+		"a/b/c.txt": {},
+		"a/d.txt":   {},
+		"e/f.txt":   {},
+	}, "a/b"}
+
+	if _, err := CreateStatsFS(fsys, ".", IncludeAll); !errors.Is(err, errBroken) {
+		t.Errorf("Serial scan: expected error, got %v", err)
+	}
+	if _, err := CreateStatsParallel(fsys, ".", IncludeAll, 4); !errors.Is(err, errBroken) {
+		t.Errorf("Parallel scan: expected error, got %v", err)
+	}
+
+	// pruned directories are never read
+	skipB := func(rel string, d fs.DirEntry) Decision {
+		if rel == filepath.Join("a", "b") {
+			return SkipSubtree
+		}
+		return Include
+	}
+	if _, err := CreateStatsParallel(fsys, ".", skipB, 4); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err := CreateStatsParallel(fsys, "missing", IncludeAll, 4); err == nil {
+		t.Errorf("Missing root not reported")
+	}
+}
+
+func benchmarkTree(b *testing.B) fs.FS {
+	root := filepath.Join(b.TempDir(), "tree")
+	makeTree(b, root, 8, 3)
+	return os.DirFS(root)
+}
+
+func BenchmarkCreateStatsSerial(b *testing.B) {
+	fsys := benchmarkTree(b)
+	for b.Loop() {
+		if _, err := CreateStatsFS(fsys, ".", IncludeAll); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreateStatsParallel(b *testing.B) {
+	fsys := benchmarkTree(b)
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				if _, err := CreateStatsParallel(fsys, ".", IncludeAll, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
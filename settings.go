@@ -0,0 +1,165 @@
+package atf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+// Settings of a device: how it connects to its peers, and the folders
+// it syncs with them. A settings file holding only the connection
+// settings is valid and declares no folder.
+type Settings struct {
+	dc.ConnectionSettings
+	Folders []FolderSettings `json:"folders,omitempty"`
+}
+
+// Folder synced by a device
+type FolderSettings struct {
+	ID   string `json:"id"`
+	Path string `json:"path"` // relative to the settings file, "~" is the home directory
+	// names of the links to the devices sharing the folder, listed by
+	// both: they meet on the signaling key "<peer>", and sync all the
+	// folders they share over one connection
+	Peers     []string         `json:"peers"`
+	Ignore    []string         `json:"ignore,omitempty"` // patterns added to the ignore files
+	Conflicts ConflictStrategy `json:"conflicts,omitempty"`
+	Mode      FolderMode       `json:"mode,omitempty"`
+	Key       string           `json:"key,omitempty"` // shared key file authenticating the peers
+}
+
+var folderIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Loads and validates the settings in path. Relative paths are
+// resolved against its directory.
+func LoadSettings(path string) (*Settings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read settings: %w", err)
+	}
+	s := new(Settings)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid settings %s: %w", path, err)
+	}
+	if err := s.resolve(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("invalid settings %s: %w", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid settings %s:\n%w", path, err)
+	}
+	return s, nil
+}
+
+// Makes the paths of the folders absolute
+func (s *Settings) resolve(base string) error {
+	home, homeErr := os.UserHomeDir()
+	for i := range s.Folders {
+		f := &s.Folders[i]
+		for _, p := range []*string{&f.Path, &f.Key} {
+			switch {
+			case *p == "":
+			case *p == "~" || strings.HasPrefix(*p, "~"+string(filepath.Separator)):
+				if homeErr != nil {
+					return fmt.Errorf("folder %q: %w", f.ID, homeErr)
+				}
+				*p = filepath.Join(home, (*p)[1:])
+			case !filepath.IsAbs(*p):
+				*p = filepath.Join(base, *p)
+			default:
+				*p = filepath.Clean(*p)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks the settings, reporting every problem found
+func (s *Settings) Validate() error {
+	errs := make([]error, 0)
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if s.Signaling == "" {
+		fail("no signaling server: set Signaling to ws://<host>:<port>")
+	} else if u, err := url.Parse(s.Signaling); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		fail("signaling server %q is not a ws:// or wss:// address", s.Signaling)
+	}
+
+	ids := make(map[string]bool, len(s.Folders))
+	for i, f := range s.Folders {
+		name := fmt.Sprintf("folder %d", i+1)
+		switch {
+		case f.ID == "":
+			fail("%s: missing id", name)
+		case len(f.ID) > 64:
+			fail("%s: id %q is longer than 64 characters", name, f.ID)
+		case !folderIDPattern.MatchString(f.ID):
+			fail("%s: id %q may only hold letters, digits, '.', '_' and '-'", name, f.ID)
+		case ids[f.ID]:
+			fail("%s: id %q is used by another folder", name, f.ID)
+		default:
+			name = fmt.Sprintf("folder %q", f.ID)
+		}
+		ids[f.ID] = true
+
+		if f.Path == "" {
+			fail("%s: missing path", name)
+		} else if info, err := os.Stat(f.Path); err == nil && !info.IsDir() {
+			fail("%s: path %s is not a directory", name, f.Path)
+		}
+		for _, other := range s.Folders[:i] {
+			if f.Path != "" && other.Path != "" && (f.Path == other.Path || within(f.Path, other.Path) || within(other.Path, f.Path)) {
+				fail("%s: path %s overlaps the one of folder %q", name, f.Path, other.ID)
+			}
+		}
+
+		if len(f.Peers) == 0 {
+			fail("%s: no peers to sync with", name)
+		}
+		for j, peer := range f.Peers {
+			if peer == "" || strings.Contains(peer, "/") {
+				fail("%s: invalid peer name %q", name, peer)
+			} else if slices.Contains(f.Peers[:j], peer) {
+				fail("%s: peer %q is listed twice", name, peer)
+			}
+		}
+		if _, err := ParseConflictStrategy(string(f.Conflicts)); err != nil {
+			fail("%s: %w", name, err)
+		}
+		if _, err := ParseFolderMode(string(f.Mode)); err != nil {
+			fail("%s: %w", name, err)
+		}
+		if f.Key != "" {
+			if _, err := os.Stat(f.Key); err != nil {
+				fail("%s: key: %w", name, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Adds the ignore patterns of the folder to ignore
+func (f *FolderSettings) AddIgnored(ignore *IgnoreRules) {
+	for _, pattern := range f.Ignore {
+		ignore.Add("", pattern)
+	}
+}
+
+// Overrides config with the settings given for the folder
+func (f *FolderSettings) Apply(config *FolderConfig) {
+	if f.Mode != "" {
+		config.Mode = f.Mode
+	}
+	if f.Conflicts != "" {
+		config.Conflicts = f.Conflicts
+	}
+}
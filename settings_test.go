@@ -0,0 +1,96 @@
+package atf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.json")
+	os.WriteFile(filepath.Join(dir, "docs.key"), make([]byte, 32), 0600)
+	os.MkdirAll(filepath.Join(dir, "photos"), 0755)
+
+	// connection settings alone are still valid
+	os.WriteFile(path, []byte(`{"Signaling": "ws://0.0.0.0:8080", "Key": "room", "BufferSize": 1}`), 0644)
+	settings, err := LoadSettings(path)
+	if err != nil || settings.Key != "room" || len(settings.Folders) != 0 {
+		t.Fatalf("Unexpected settings %+v (%v)", settings, err)
+	}
+
+	os.WriteFile(path, []byte(`{
+		"Signaling": "wss://example.org",
+		"folders": [
+			{"id": "docs", "path": "docs", "peers": ["laptop", "phone"], "key": "docs.key",
+			 "conflicts": "copy", "ignore": ["*.tmp"]},
+			{"id": "photos", "path": "`+filepath.Join(dir, "photos")+`/", "peers": ["laptop"], "mode": "send-only"}
+		]
+	}`), 0644)
+	settings, err = LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, photos := settings.Folders[0], settings.Folders[1]
+	if docs.Path != filepath.Join(dir, "docs") || docs.Key != filepath.Join(dir, "docs.key") || photos.Path != filepath.Join(dir, "photos") {
+		t.Errorf("Paths not resolved: %+v", settings.Folders)
+	}
+	config := &FolderConfig{Mode: SendReceive, Conflicts: KeepLatest}
+	photos.Apply(config)
+	if config.Mode != SendOnly || config.Conflicts != KeepLatest {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	ignore := new(IgnoreRules)
+	docs.AddIgnored(ignore)
+	if !ignore.Ignored(filepath.Join("a", "b.tmp"), false) {
+		t.Errorf("Ignore patterns not applied")
+	}
+
+	// every problem is reported
+	os.WriteFile(path, []byte(`{
+		"Signaling": "http://example.org",
+		"folders": [
+			{"id": "docs", "path": "docs", "peers": ["laptop", "laptop"]},
+			{"id": "docs", "path": "docs/sub", "peers": []},
+			{"id": "bad id", "path": "docs.key", "peers": ["a/b"], "conflicts": "newest", "mode": "both", "key": "missing.key"},
+			{"path": "other", "peers": ["laptop"]}
+		]
+	}`), 0644)
+	_, err = LoadSettings(path)
+	if err == nil {
+		t.Fatal("Loaded invalid settings")
+	}
+	for _, problem := range []string{
+		`signaling server "http://example.org"`,
+		`folder "docs": peer "laptop" is listed twice`,
+		`folder 2: id "docs" is used by another folder`,
+		`folder 2: path ` + filepath.Join(dir, "docs", "sub") + ` overlaps the one of folder "docs"`,
+		`folder 2: no peers`,
+		`folder 3: id "bad id"`,
+		`folder 3: path ` + filepath.Join(dir, "docs.key") + ` is not a directory`,
+		`folder 3: invalid peer name "a/b"`,
+		`folder 3: unknown conflict strategy "newest"`,
+		`folder 3: unknown folder mode "both"`,
+		`folder 3: key: `,
+		`folder 4: missing id`,
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q not reported in:\n%v", problem, err)
+		}
+	}
+}
+
+func TestConflictCopyName(t *testing.T) {
+	now := time.Date(2026, 10, 19, 15, 5, 50, 0, time.UTC)
+	for p, expected := range map[string]string{
+		filepath.Join("a", "f.txt"): filepath.Join("a", "f.conflict-20261019-150550.txt"),
+		"Makefile":                  "Makefile.conflict-20261019-150550",
+		".bashrc":                   ".bashrc.conflict-20261019-150550",
+	} {
+		if name := ConflictCopyName(p, now); name != expected {
+			t.Errorf("%s: expected %s, got %s", p, expected, name)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 )
 
@@ -16,12 +17,42 @@ type StatPair struct {
 }
 
 func CreateStats(dir string, policy func(string) bool) (Stats, error) {
+	return CreateStatsWith(dir, FromPredicate(dir, policy))
+}
+
+// Scans dir, keeping the paths selected by policy.
+// Directories skipped by policy are not descended into, nor is the
+// MetaDir of dir.
+func CreateStatsWith(dir string, policy Policy) (Stats, error) {
+	return CreateStatsFS(os.DirFS(dir), ".", And(ExcludeMeta, policy))
+}
+
+// Scans the tree rooted at root in fsys, keeping the paths selected by
+// policy. Keys are relative to root and use the OS separator, whatever
+// the spelling of root.
+func CreateStatsFS(fsys fs.FS, root string, policy Policy) (Stats, error) {
 	stats := make(Stats)
-	dirFunc := func(path string, info fs.DirEntry, err error) error {
+	root = path.Clean(root)
+	dirFunc := func(p string, info fs.DirEntry, err error) error {
 		if err != nil {
-				return err
+			return err
 		}
-		if !policy(path) || path==dir {
+		if p == root {
+			return nil
+		}
+
+		rel := p
+		if root != "." {
+			rel = p[len(root)+1:] // exclude root prefix
+		}
+		rel = filepath.FromSlash(rel)
+		switch policy(rel, info) {
+		case Exclude:
+			return nil
+		case SkipSubtree:
+			if info.IsDir() {
+				return fs.SkipDir
+			}
 			return nil
 		}
 
@@ -30,13 +61,12 @@ func CreateStats(dir string, policy func(string) bool) (Stats, error) {
 			return err
 		}
 
-		path = path[len(dir)+1:] // exclude dir prefix
-		stats[path] = CloneInfo(os.FileInfo(fileInfo))
+		stats[rel] = CloneInfo(fileInfo)
 		return nil
 	}
 
-	filepath.WalkDir(dir, dirFunc)
-	return stats, nil
+	err := fs.WalkDir(fsys, root, dirFunc)
+	return stats, err
 }
 
 // Returns keys that are in a but not in b
@@ -58,7 +88,7 @@ func StatsValueDiff(a, b Stats) []string {
 	diff := make([]string, 0, 1) 
 	for ka, va := range a {
 	  vb, ok := b[ka];
-		if ok && vb != va {
+		if ok && !vb.Same(va) {
 			diff = append(diff, ka)
 		}
 	}
@@ -1,9 +1,12 @@
 package atf
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"slices"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -89,3 +92,52 @@ func TestJson(t *testing.T) {
 					s1, s2)
 	}
 }
+
+func TestCreateStatsFS(t *testing.T) {
+	modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"root/a.txt":        {Data: []byte("hello"), ModTime: modTime},
+		"root/sub/b.txt":    {Data: []byte("world"), ModTime: modTime},
+		"root/.git/config":  {Data: []byte("x")},
+		"other/c.txt":       {Data: []byte("!")},
+	}
+
+	for _, root := range []string{"root", "root/", "./root", "other/../root"} {
+		stats, err := CreateStatsFS(fsys, root, ExcludeHidden)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", root, err)
+		}
+		keys := make([]string, 0, len(stats))
+		for k := range stats {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		expected := []string{"a.txt", "sub", filepath.Join("sub", "b.txt")}
+		if !slices.Equal(keys, expected) {
+			t.Errorf("%s: expected %v, got %v", root, expected, keys)
+		}
+		if info := stats["a.txt"]; info.Size != 5 || !info.ModTime.Equal(modTime) {
+			t.Errorf("%s: wrong info %#v", root, info)
+		}
+	}
+
+	if _, err := CreateStatsFS(fsys, "missing", IncludeAll); err == nil {
+		t.Errorf("Missing root not reported")
+	}
+}
+
+func TestCreateStatsSpelling(t *testing.T) {
+	in_dir := GetTmpName([]string{"stat_spelling_test"})
+	MakePlayground(in_dir, []string{"f1.txt", PathJoin([]string{"d1", "f2.txt"})})
+	defer os.RemoveAll(in_dir)
+
+	expected, _ := CreateStatsWith(in_dir, IncludeAll)
+	cwd, _ := os.Getwd()
+	relative, _ := filepath.Rel(cwd, in_dir)
+	for _, dir := range []string{in_dir + string(os.PathSeparator), relative} {
+		stats, err := CreateStatsWith(dir, IncludeAll)
+		if err != nil || !reflect.DeepEqual(stats, expected) {
+			t.Errorf("%s: expected %v, got %v (%v)", dir, expected, stats, err)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package atf
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"iter"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+// Largest payload of a batch sent over the wire, well within the
+// message limits of data channels
+const BatchSize = 16 * 1024
+
+// Orders paths component by component, as a directory walk visits them:
+// a directory comes right before its content.
+func ComparePaths(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := a[i], b[i]
+		if ca == cb {
+			continue
+		}
+		if ca == os.PathSeparator {
+			return -1
+		}
+		if cb == os.PathSeparator {
+			return 1
+		}
+		if ca < cb {
+			return -1
+		}
+		return 1
+	}
+	return len(a) - len(b)
+}
+
+// Returns the keys of s in ComparePaths order
+func SortedKeys(s Stats) []string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, ComparePaths)
+	return keys
+}
+
+// Iterates over s in ComparePaths order
+func SortedStats(s Stats) iter.Seq2[string, FileInfo] {
+	return func(yield func(string, FileInfo) bool) {
+		for _, k := range SortedKeys(s) {
+			if !yield(k, s[k]) {
+				return
+			}
+		}
+	}
+}
+
+// Iterates over seq, recording in s the entries as they are yielded
+func TeeStats(seq iter.Seq2[string, FileInfo], s Stats) iter.Seq2[string, FileInfo] {
+	return func(yield func(string, FileInfo) bool) {
+		for k, info := range seq {
+			s[k] = info
+			if !yield(k, info) {
+				return
+			}
+		}
+	}
+}
+
+// Walks the tree rooted at root in fsys, yielding the entries selected
+// by policy in ComparePaths order, without keeping them in memory.
+// If the walk fails, the iteration stops and the error is stored in err.
+func ScanSeq(fsys fs.FS, root string, policy Policy, err *error) iter.Seq2[string, FileInfo] {
+	return func(yield func(string, FileInfo) bool) {
+		for rel, entry := range walkSeq(fsys, root, policy, err) {
+			if !yield(rel, CloneInfo(entry.info)) {
+				return
+			}
+		}
+	}
+}
+
+// Entry met by walkSeq
+type walkEntry struct {
+	path string // in the walked fs.FS
+	info fs.FileInfo
+}
+
+// Walks like ScanSeq, yielding the raw info of the entries
+func walkSeq(fsys fs.FS, root string, policy Policy, err *error) iter.Seq2[string, walkEntry] {
+	return func(yield func(string, walkEntry) bool) {
+		root := path.Clean(root)
+		stop := errors.New("stop")
+		walkErr := fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == root {
+				return nil
+			}
+			rel := p
+			if root != "." {
+				rel = p[len(root)+1:]
+			}
+			rel = filepath.FromSlash(rel)
+			switch policy(rel, d) {
+			case Exclude:
+				return nil
+			case SkipSubtree:
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if !yield(rel, walkEntry{p, info}) {
+				return stop
+			}
+			return nil
+		})
+		if walkErr != nil && walkErr != stop {
+			*err = walkErr
+		}
+	}
+}
+
+// Kind of change of a path between two Stats
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Deleted
+	Modified
+)
+
+type Change struct {
+	Kind ChangeKind
+	Old  FileInfo // zero if Added
+	New  FileInfo // zero if Deleted
+}
+
+// Compares two sequences sorted in ComparePaths order, yielding the
+// paths added, deleted or modified from old to new. Both are consumed
+// once, side by side.
+func DiffSeq(old, new iter.Seq2[string, FileInfo]) iter.Seq2[string, Change] {
+	return func(yield func(string, Change) bool) {
+		nextOld, stopOld := iter.Pull2(old)
+		defer stopOld()
+		nextNew, stopNew := iter.Pull2(new)
+		defer stopNew()
+
+		ko, vo, okOld := nextOld()
+		kn, vn, okNew := nextNew()
+		for okOld || okNew {
+			cmp := 0
+			switch {
+			case !okOld:
+				cmp = 1
+			case !okNew:
+				cmp = -1
+			default:
+				cmp = ComparePaths(ko, kn)
+			}
+
+			switch {
+			case cmp < 0:
+				if !yield(ko, Change{Kind: Deleted, Old: vo}) {
+					return
+				}
+				ko, vo, okOld = nextOld()
+			case cmp > 0:
+				if !yield(kn, Change{Kind: Added, New: vn}) {
+					return
+				}
+				kn, vn, okNew = nextNew()
+			default:
+				if !vo.Same(vn) && !yield(kn, Change{Kind: Modified, Old: vo, New: vn}) {
+					return
+				}
+				ko, vo, okOld = nextOld()
+				kn, vn, okNew = nextNew()
+			}
+		}
+	}
+}
+
+// Sends items as JSON arrays of at most BatchSize bytes, unless a single
+// item is larger, followed by an empty array marking the end.
+func SendBatches[T any](c dc.IOChannel, items iter.Seq[T]) error {
+	batch := make([]json.RawMessage, 0)
+	size := 0
+	flush := func() error {
+		data, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		c.Send(data)
+		batch, size = batch[:0], 0
+		return nil
+	}
+
+	for item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if size+len(data) > BatchSize && len(batch) > 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, data)
+		size += len(data) + 1
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// Receives the items sent by SendBatches, one batch in memory at a time.
+// The whole stream is always read from c, even if the iteration stops
+// early, so that c stays in sync. If a batch cannot be decoded, a zero
+// item is yielded with the error, and the rest of the stream is skipped.
+func RecvBatches[T any](c dc.IOChannel) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		more := true
+		for {
+			var batch []T
+			data := c.Recv()
+			if err := json.Unmarshal(data, &batch); err != nil {
+				var zero T
+				if more {
+					yield(zero, err)
+				}
+				if data != nil {
+					skipBatches(c)
+				}
+				return
+			}
+			if len(batch) == 0 {
+				return
+			}
+			for _, item := range batch {
+				if more && !yield(item, nil) {
+					more = false
+				}
+			}
+		}
+	}
+}
+
+// Reads batches up to the empty one ending the stream, or until c is
+// closed
+func skipBatches(c dc.IOChannel) {
+	for {
+		data := c.Recv()
+		var batch []json.RawMessage
+		if data == nil || json.Unmarshal(data, &batch) == nil && len(batch) == 0 {
+			return
+		}
+	}
+}
+
+// Sends stats in batches, see SendBatches
+func SendStats(c dc.IOChannel, stats iter.Seq2[string, FileInfo]) error {
+	return SendBatches(c, func(yield func(StatPair) bool) {
+		for name, info := range stats {
+			if !yield(StatPair{name, info}) {
+				return
+			}
+		}
+	})
+}
+
+// Receives the stats sent by SendStats
+func RecvStats(c dc.IOChannel) (Stats, error) {
+	stats := make(Stats)
+	for pair, err := range RecvBatches[StatPair](c) {
+		if err != nil {
+			return stats, err
+		}
+		stats[pair.Name] = pair.Info
+	}
+	return stats, nil
+}
+
+// Sends paths in ComparePaths order, in batches
+func SendPaths(c dc.IOChannel, paths []string) error {
+	sorted := slices.Clone(paths)
+	slices.SortFunc(sorted, ComparePaths)
+	return SendBatches(c, slices.Values(sorted))
+}
+
+// Receives the paths sent by SendPaths
+func RecvPaths(c dc.IOChannel) ([]string, error) {
+	return recvList[string](c)
+}
+
+// Receives all the items sent by SendBatches
+func recvList[T any](c dc.IOChannel) ([]T, error) {
+	items := make([]T, 0)
+	for item, err := range RecvBatches[T](c) {
+		if err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
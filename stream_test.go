@@ -0,0 +1,146 @@
+package atf
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestComparePaths(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_stream"})
+	defer os.RemoveAll(root)
+	MakePlayground(root, []string{"a.txt", "a/b", "a/c/d", "a-b", "b", "ab/c"})
+	fsys := os.DirFS(root)
+
+	walked := make([]string, 0)
+	var err error
+	for k := range ScanSeq(fsys, ".", IncludeAll, &err) {
+		walked = append(walked, k)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.IsSortedFunc(walked, ComparePaths) {
+		t.Errorf("Walk order is not ComparePaths order: %v", walked)
+	}
+
+	stats, _ := CreateStatsFS(fsys, ".", IncludeAll)
+	if !slices.Equal(SortedKeys(stats), walked) {
+		t.Errorf("Expected %v, got %v", walked, SortedKeys(stats))
+	}
+	scanned := maps.Collect(ScanSeq(fsys, ".", IncludeAll, &err))
+	if !reflect.DeepEqual(scanned, stats) {
+		t.Errorf("ScanSeq and CreateStatsFS differ")
+	}
+
+	// early stop is not an error
+	for range ScanSeq(fsys, ".", IncludeAll, &err) {
+		break
+	}
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	ScanSeq(fsys, "missing", IncludeAll, &err)(func(string, FileInfo) bool { return true })
+	if err == nil {
+		t.Errorf("Missing root not reported")
+	}
+}
+
+func TestDiffSeq(t *testing.T) {
+	now := time.Now()
+	old := Stats{
+		"a":     {Name: "a", IsDir: true},
+		"a/x":   {Name: "x", Size: 1},
+		"a/y":   {Name: "y", Size: 1},
+		"b.txt": {Name: "b.txt"},
+		"c/d/e": {Name: "e"},
+		"d":     {Name: "d", Digest: "01"},
+	}
+	// databases written before digests were recorded have none
+	new := Stats{
+		"a":     {Name: "a", IsDir: true},
+		"a/x":   {Name: "x", Size: 2},
+		"a.txt": {Name: "a.txt"},
+		"b.txt": {Name: "b.txt", Digest: "ab"},
+		"c/d/f": {Name: "f", ModTime: now},
+		"d":     {Name: "d", Digest: "02"},
+	}
+
+	changes := map[ChangeKind][]string{}
+	for k, c := range DiffSeq(SortedStats(old), SortedStats(new)) {
+		changes[c.Kind] = append(changes[c.Kind], k)
+	}
+	check := func(kind ChangeKind, expected []string) {
+		got := changes[kind]
+		slices.Sort(got)
+		slices.Sort(expected)
+		if !slices.Equal(got, expected) {
+			t.Errorf("Kind %d: expected %v, got %v", kind, expected, got)
+		}
+	}
+	check(Added, StatsKeyDiff(new, old))
+	check(Deleted, StatsKeyDiff(old, new))
+	check(Modified, StatsValueDiff(new, old))
+	check(Modified, []string{"a/x", "d"})
+}
+
+func TestBatches(t *testing.T) {
+	stats := make(Stats)
+	for i := range 2000 {
+		name := fmt.Sprintf("dir%d/file%d.txt", i%7, i)
+		stats[name] = FileInfo{Name: name, Size: int64(i)}
+	}
+	p1, p2 := MakePipes(1024)
+	if err := SendStats(p1, SortedStats(stats)); err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([][]byte, 0)
+	for len(p1.In) > 0 {
+		msgs = append(msgs, <-p1.In)
+	}
+	if len(msgs) < 3 {
+		t.Errorf("Expected several batches, got %d messages", len(msgs))
+	}
+	for _, msg := range msgs {
+		if len(msg) > BatchSize+2 {
+			t.Errorf("Batch of %d bytes", len(msg))
+		}
+		p1.In <- msg
+	}
+	got, err := RecvStats(p2)
+	if err != nil || !reflect.DeepEqual(got, stats) {
+		t.Errorf("Stats differ after the round trip (%v)", err)
+	}
+
+	// an early stop still drains the stream
+	SendPaths(p1, []string{"b", "a/b", "a"})
+	p1.Send([]byte("next"))
+	for p := range RecvBatches[string](p2) {
+		if p != "a" {
+			t.Errorf("Paths not sorted: got %s first", p)
+		}
+		break
+	}
+	if next := p2.Recv(); string(next) != "next" {
+		t.Errorf("Stream not drained, got %s", next)
+	}
+
+	// so does a batch that cannot be decoded
+	SendBatches(p1, slices.Values([]int{1, 2}))
+	p1.Send([]byte("next"))
+	if _, err := RecvPaths(p2); err == nil {
+		t.Errorf("Numbers decoded as paths")
+	}
+	if next := p2.Recv(); string(next) != "next" {
+		t.Errorf("Stream not drained after an error, got %s", next)
+	}
+
+	SendPaths(p1, nil)
+	if paths, err := RecvPaths(p2); err != nil || len(paths) != 0 {
+		t.Errorf("Expected no paths, got %v %v", paths, err)
+	}
+}
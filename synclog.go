@@ -0,0 +1,109 @@
+package atf
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Directory of a folder holding the log of its syncs
+var SyncLogDir = filepath.Join(MetaDir, "log")
+
+// Syncs kept in the log, the oldest are dropped
+const MaxSyncEvents = 1000
+
+// Side whose version of a file was kept
+type ConflictSide string
+
+const (
+	LocalSide  ConflictSide = "local"
+	RemoteSide ConflictSide = "remote"
+)
+
+// File changed on both sides since the last sync, solved by keeping the
+// latest modification
+type Conflict struct {
+	Path     string       `json:"path"`
+	Winner   ConflictSide `json:"winner"`
+	Deleted  bool         `json:"deleted,omitempty"` // deleted by the peer, modified locally
+	Copy     string       `json:"copy,omitempty"`    // conflict copy of the local version
+	Version  string       `json:"version,omitempty"` // file of the versions keeping the local version
+	Resolved bool         `json:"resolved,omitempty"`
+}
+
+// Summary of a sync
+type SyncEvent struct {
+	Time      time.Time  `json:"time"`
+	Peer      string     `json:"peer"`     // fingerprint
+	Sent      int        `json:"sent"`     // local changes announced
+	Received  int        `json:"received"` // files requested
+	Deleted   int        `json:"deleted"`
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+}
+
+// Log of the syncs of a folder
+type SyncLog struct {
+	dir    string
+	Events []SyncEvent // oldest first
+}
+
+// Opens the log of the folder dir, empty if missing
+func OpenSyncLog(dir string) (*SyncLog, error) {
+	l := &SyncLog{dir: dir}
+	if err := loadIndex(filepath.Join(dir, SyncLogDir, archiveIndex), &l.Events); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Writes the log
+func (l *SyncLog) Save() error {
+	return saveIndex(filepath.Join(l.dir, SyncLogDir), l.Events, len(l.Events) == 0)
+}
+
+// Appends e, dropping the oldest events beyond MaxSyncEvents
+func (l *SyncLog) Add(e SyncEvent) {
+	l.Events = append(l.Events, e)
+	if extra := len(l.Events) - MaxSyncEvents; extra > 0 {
+		l.Events = slices.Delete(l.Events, 0, extra)
+	}
+}
+
+// Returns the latest unresolved conflict of each path, newest first,
+// with the time of its sync
+func (l *SyncLog) Conflicts() ([]Conflict, []time.Time) {
+	seen := make(map[string]bool)
+	conflicts, times := make([]Conflict, 0), make([]time.Time, 0)
+	for _, e := range slices.Backward(l.Events) {
+		for _, c := range e.Conflicts {
+			if seen[c.Path] {
+				continue
+			}
+			seen[c.Path] = true
+			if !c.Resolved {
+				conflicts = append(conflicts, c)
+				times = append(times, e.Time)
+			}
+		}
+	}
+	return conflicts, times
+}
+
+// Marks the conflicts of rel as resolved, returning the latest one
+func (l *SyncLog) Resolve(rel string) (Conflict, error) {
+	rel = filepath.Clean(rel)
+	var latest *Conflict
+	for i := range l.Events {
+		for j := range l.Events[i].Conflicts {
+			if c := &l.Events[i].Conflicts[j]; c.Path == rel && !c.Resolved {
+				c.Resolved = true
+				latest = c
+			}
+		}
+	}
+	if latest == nil {
+		return Conflict{}, fmt.Errorf("%s has no unresolved conflict", rel)
+	}
+	return *latest, nil
+}
@@ -0,0 +1,47 @@
+package atf
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncLog(t *testing.T) {
+	root := t.TempDir()
+	log, err := OpenSyncLog(root)
+	if err != nil || len(log.Events) != 0 {
+		t.Fatalf("A missing log must be empty (%v)", err)
+	}
+	start := time.Now().UTC()
+	for i := range MaxSyncEvents + 2 {
+		log.Add(SyncEvent{Time: start.Add(time.Duration(i) * time.Second), Peer: "p", Sent: i})
+	}
+	if len(log.Events) != MaxSyncEvents || log.Events[0].Sent != 2 {
+		t.Fatalf("Expected the %d latest events, got %d from %d", MaxSyncEvents, len(log.Events), log.Events[0].Sent)
+	}
+
+	f := filepath.Join("a", "f.txt")
+	log.Add(SyncEvent{Time: start, Conflicts: []Conflict{{Path: f, Winner: RemoteSide}, {Path: "g", Winner: LocalSide}}})
+	log.Add(SyncEvent{Time: start.Add(time.Hour), Conflicts: []Conflict{{Path: f, Winner: LocalSide, Deleted: true}}})
+	if err := log.Save(); err != nil {
+		t.Fatal(err)
+	}
+	log, err = OpenSyncLog(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts, times := log.Conflicts()
+	if len(conflicts) != 2 || conflicts[0].Winner != LocalSide || !conflicts[0].Deleted || !times[0].Equal(start.Add(time.Hour)) {
+		t.Fatalf("Expected the latest conflict of each path, got %+v", conflicts)
+	}
+
+	if c, err := log.Resolve("a/./f.txt"); err != nil || c.Winner != LocalSide {
+		t.Errorf("Resolved %+v (%v)", c, err)
+	}
+	if _, err := log.Resolve(f); err == nil {
+		t.Errorf("Resolved a conflict twice")
+	}
+	if conflicts, _ := log.Conflicts(); len(conflicts) != 1 || conflicts[0].Path != "g" {
+		t.Errorf("Expected only g unresolved, got %+v", conflicts)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"sync"
 	dc "github.com/leogem2003/directchan"
 	"testing"
@@ -58,6 +59,42 @@ func DirsEqual(dir1, dir2 string) (bool, error) {
 	return true, nil
 }
  
+// Like DirsEqual, but skips the entries named excluded at the top of
+// both dirs
+func DirsEqualExcluding(dir1, dir2 string, excluded ...string) (bool, error) {
+	list := func(dir string) ([]os.DirEntry, error) {
+		entries, err := os.ReadDir(dir)
+		return slices.DeleteFunc(entries, func(e os.DirEntry) bool {
+			return slices.Contains(excluded, e.Name())
+		}), err
+	}
+	d1, err := list(dir1)
+	if err != nil {
+		return false, err
+	}
+	d2, err := list(dir2)
+	if err != nil {
+		return false, err
+	}
+	if len(d1) != len(d2) {
+		return false, nil
+	}
+	for i := range d1 {
+		info1, _ := d1[i].Info()
+		info2, _ := d2[i].Info()
+		if d1[i].Name() != d2[i].Name() || d1[i].IsDir() != d2[i].IsDir() || info1.Mode() != info2.Mode() {
+			return false, nil
+		}
+		if d1[i].IsDir() {
+			equal, err := DirsEqual(filepath.Join(dir1, d1[i].Name()), filepath.Join(dir2, d2[i].Name()))
+			if !equal || err != nil {
+				return equal, err
+			}
+		}
+	}
+	return true, nil
+}
+
 func CheckEqual(root1, root2 string, t *testing.T) {
 	equal, err := DirsEqual(root1, root2)
 	if err != nil {
@@ -67,6 +104,17 @@ func CheckEqual(root1, root2 string, t *testing.T) {
 	}
 }
 
+// Checks that the synced content of two folders is equal: the metadata
+// directory of each differs
+func CheckSynced(root1, root2 string, t *testing.T) {
+	equal, err := DirsEqualExcluding(root1, root2, MetaDir)
+	if err != nil {
+		t.Fatalf("Error while comparing dirs: %v", err)
+	} else if !equal {
+		t.Fatal("Result dirs differ")
+	}
+}
+
 
 func RunPrg(arg1, arg2 []string, t *testing.T) {
 	var wg sync.WaitGroup
@@ -116,3 +164,24 @@ func MakeSettings(key string) (string, error) {
 	b, _ := json.Marshal(settings)
 	return settingsPath, os.WriteFile(settingsPath, b, 0644)
 }
+
+// In-memory ordered channel, used to connect two endpoints in tests
+type Pipe struct {
+	In  chan []byte
+	Out chan []byte
+}
+
+func (p *Pipe) Send(b []byte) {
+	p.In <- b
+}
+
+func (p *Pipe) Recv() []byte {
+	return <-p.Out
+}
+
+// Returns two connected pipes with buffers of the given size
+func MakePipes(size int) (*Pipe, *Pipe) {
+	a := make(chan []byte, size)
+	b := make(chan []byte, size)
+	return &Pipe{In: a, Out: b}, &Pipe{In: b, Out: a}
+}
@@ -0,0 +1,107 @@
+package atf
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"slices"
+
+	dc "github.com/leogem2003/directchan"
+)
+
+// Frame types used to stream file contents.
+// A transfer is a sequence of data frames terminated by a digest frame
+// carrying the SHA-256 of the data sent.
+const (
+	DataFrame   byte = 'D'
+	DigestFrame byte = 'H'
+)
+
+// Suffix of the files holding content not verified yet
+const PartialSuffix = ".atfpart"
+
+// Returned when received content does not match the size or the
+// digest announced by the sender. The transfer can be retried.
+var ErrIntegrity = errors.New("integrity check failed")
+
+func NewDigest() hash.Hash {
+	return sha256.New()
+}
+
+// Returns the name of the partial file used while receiving path.
+// The partial file lives in the same directory so that it can be
+// renamed over path once verified.
+func PartialName(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+PartialSuffix)
+}
+
+// Streams the content of r over c, chunkSize bytes at a time,
+// followed by its digest. Returns the number of bytes sent.
+// On read errors the trailer is still sent, with an empty digest,
+// so that the receiver stays in sync and reports a mismatch.
+func SendContent(c dc.IOChannel, r io.Reader, chunkSize int) (int64, error) {
+	h := NewDigest()
+	buf := make([]byte, chunkSize)
+	var sent int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			c.Send(slices.Concat([]byte{DataFrame}, buf[:n]))
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.Send([]byte{DigestFrame})
+			return sent, err
+		}
+	}
+	c.Send(slices.Concat([]byte{DigestFrame}, h.Sum(nil)))
+	return sent, nil
+}
+
+// Receives the content streamed by SendContent and writes it to w.
+// Data beyond size is discarded. Once the trailer arrives, the amount of
+// data and its digest are checked: on mismatch an error wrapping
+// ErrIntegrity is returned.
+func RecvContent(c dc.IOChannel, w io.Writer, size int64) error {
+	h := NewDigest()
+	var received int64
+	var writeErr error
+	for {
+		frame := c.Recv()
+		if len(frame) == 0 {
+			return errors.New("unexpected empty frame")
+		}
+
+		switch frame[0] {
+		case DataFrame:
+			chunk := frame[1:]
+			received += int64(len(chunk))
+			if received > size || writeErr != nil {
+				continue // keep consuming until the trailer
+			}
+			h.Write(chunk)
+			_, writeErr = w.Write(chunk)
+		case DigestFrame:
+			if writeErr != nil {
+				return writeErr
+			}
+			if received != size {
+				return fmt.Errorf("%w: expected %d bytes, received %d", ErrIntegrity, size, received)
+			}
+			if subtle.ConstantTimeCompare(frame[1:], h.Sum(nil)) != 1 {
+				return fmt.Errorf("%w: digest mismatch", ErrIntegrity)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unexpected frame type %q", frame[0])
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package atf
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// Sends payload with SendContent, applying tamper to every frame
+func sendTampered(payload []byte, tamper func([]byte) []byte) *Pipe {
+	tx, rx := MakePipes(64)
+	go func() {
+		raw, mitm := MakePipes(64)
+		go SendContent(raw, bytes.NewReader(payload), 16)
+		for {
+			frame := mitm.Recv()
+			tx.Send(tamper(slices.Clone(frame)))
+			if frame[0] == DigestFrame {
+				return
+			}
+		}
+	}()
+	return rx
+}
+
+func TestContentTransfer(t *testing.T) {
+	payload := make([]byte, 100)
+	rand.Read(payload)
+
+	rx := sendTampered(payload, func(b []byte) []byte { return b })
+	out := new(bytes.Buffer)
+	if err := RecvContent(rx, out, int64(len(payload))); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("Content differ")
+	}
+
+	corrupt := func(b []byte) []byte {
+		if b[0] == DataFrame {
+			b[1] ^= 0xff
+		}
+		return b
+	}
+	rx = sendTampered(payload, corrupt)
+	err := RecvContent(rx, new(bytes.Buffer), int64(len(payload)))
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Corrupted content: expected integrity error, got %v", err)
+	}
+
+	rx = sendTampered(payload, func(b []byte) []byte { return b })
+	out.Reset()
+	err = RecvContent(rx, out, int64(len(payload)-10))
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Over-long stream: expected integrity error, got %v", err)
+	}
+	if out.Len() > len(payload)-10 {
+		t.Errorf("Over-long stream: wrote %d bytes", out.Len())
+	}
+
+	rx = sendTampered(payload, func(b []byte) []byte { return b })
+	err = RecvContent(rx, new(bytes.Buffer), int64(len(payload)+10))
+	if !errors.Is(err, ErrIntegrity) {
+		t.Errorf("Short stream: expected integrity error, got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package atf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Directory of a folder holding the data of atf, never synced
+const MetaDir = ".atf"
+
+// Directory of a folder holding its deleted files
+var TrashDir = filepath.Join(MetaDir, "trash")
+
+// Layout of the archives of a folder, the trash and the versions
+const archiveIndex = "index.json"
+const archiveFiles = "files"
+
+var ErrNotInTrash = errors.New("not in the trash")
+
+// File moved to the trash
+type TrashEntry struct {
+	Path    string    `json:"path"` // relative to the folder
+	File    string    `json:"file"` // relative to the files of the trash
+	Reason  string    `json:"reason"`
+	Trashed time.Time `json:"trashed"`
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+}
+
+// How long trashed files are kept: zero values are unbounded
+type Retention struct {
+	Days    int   `json:"days,omitempty"`
+	MaxSize int64 `json:"max_size,omitempty"` // bytes
+}
+
+// Trash of a folder: files are moved into it with their relative paths
+// and timestamps rather than destroyed.
+type Trash struct {
+	dir     string
+	Entries []TrashEntry // oldest first
+}
+
+// Opens the trash of the folder dir, empty if missing
+func OpenTrash(dir string) (*Trash, error) {
+	t := &Trash{dir: dir}
+	if err := loadIndex(t.path(archiveIndex), &t.Entries); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Trash) path(parts ...string) string {
+	return filepath.Join(append([]string{t.dir, TrashDir}, parts...)...)
+}
+
+// Writes the index of the trash. An empty trash that was never
+// written is left missing.
+func (t *Trash) Save() error {
+	return saveIndex(t.path(), t.Entries, len(t.Entries) == 0)
+}
+
+// Moves the file rel of the folder to the trash, recording why.
+// A missing file is not an error.
+func (t *Trash) Move(rel, reason string) error {
+	now := time.Now().UTC()
+	file, info, err := stashFile(t.dir, t.path(archiveFiles), rel, now)
+	if err != nil || info == nil {
+		return err
+	}
+	t.Entries = append(t.Entries, TrashEntry{
+		Path:    rel,
+		File:    file,
+		Reason:  reason,
+		Trashed: now,
+		ModTime: info.ModTime().UTC(),
+		Size:    info.Size(),
+	})
+	return nil
+}
+
+// Moves the latest trashed version of rel back into the folder.
+// A file in its place is trashed first.
+func (t *Trash) Restore(rel string) error {
+	rel = filepath.Clean(rel)
+	i := len(t.Entries) - 1
+	for i >= 0 && t.Entries[i].Path != rel {
+		i--
+	}
+	if i < 0 {
+		return fmt.Errorf("%s: %w", rel, ErrNotInTrash)
+	}
+	entry := t.Entries[i]
+	dst, err := SafeJoin(t.dir, rel)
+	if err != nil {
+		return err
+	}
+	if err := t.Move(rel, "restored over"); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(t.path(archiveFiles, entry.File), dst); err != nil {
+		return err
+	}
+	t.Entries = slices.Delete(t.Entries, i, i+1)
+	return nil
+}
+
+// Deletes the files older than r.Days, then the oldest ones until the
+// trash fits r.MaxSize. Returns the entries deleted.
+func (t *Trash) Prune(r Retention) ([]TrashEntry, error) {
+	var size int64
+	for _, e := range t.Entries {
+		size += e.Size
+	}
+	cutoff := time.Now().AddDate(0, 0, -r.Days)
+	pruned := make([]TrashEntry, 0)
+	for len(t.Entries) > 0 {
+		e := t.Entries[0]
+		expired := r.Days > 0 && e.Trashed.Before(cutoff)
+		tooLarge := r.MaxSize > 0 && size > r.MaxSize
+		if !expired && !tooLarge {
+			break
+		}
+		if err := os.Remove(t.path(archiveFiles, e.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pruned, err
+		}
+		size -= e.Size
+		pruned = append(pruned, e)
+		t.Entries = t.Entries[1:]
+	}
+	return pruned, nil
+}
+
+// Reads the JSON index in path into v, leaving it unchanged if missing
+func loadIndex(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("corrupted index %s: %w", path, err)
+	}
+	return nil
+}
+
+// Writes v as the index of the archive in dir, atomically.
+// An empty archive is only written if it already exists.
+func saveIndex(dir string, v any, empty bool) error {
+	path := filepath.Join(dir, archiveIndex)
+	if _, err := os.Stat(path); empty && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + PartialSuffix
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Moves the file rel of the folder dir into files, under its relative
+// path stamped with now. Returns the name given to it and its info,
+// nil if it is missing.
+func stashFile(dir, files, rel string, now time.Time) (string, fs.FileInfo, error) {
+	src, err := SafeJoin(dir, rel)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Lstat(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if info.IsDir() {
+		return "", nil, fmt.Errorf("%s is a directory", rel)
+	}
+
+	file := rel + "~" + now.Format("20060102-150405.000000000")
+	dst := filepath.Join(files, file)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", nil, err
+	}
+	// same filesystem: the rename keeps the timestamps
+	if err := os.Rename(src, dst); err != nil {
+		return "", nil, err
+	}
+	return file, info, nil
+}
@@ -0,0 +1,102 @@
+package atf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_trash"})
+	MakePlayground(root, []string{"a/f1.txt", "f2.txt"})
+	defer os.RemoveAll(root)
+	f1 := filepath.Join("a", "f1.txt")
+	os.WriteFile(filepath.Join(root, f1), []byte("old"), 0644)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(root, f1), mtime, mtime)
+
+	trash, err := OpenTrash(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trash.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, MetaDir)); err == nil {
+		t.Errorf("Empty trash written")
+	}
+
+	if err := trash.Move(f1, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := trash.Move("missing", "deleted"); err != nil {
+		t.Errorf("Moving a missing file: %v", err)
+	}
+	if err := trash.Move("a", "deleted"); err == nil {
+		t.Errorf("Moved a directory")
+	}
+	if _, err := os.Stat(filepath.Join(root, f1)); err == nil {
+		t.Errorf("%s still in the folder", f1)
+	}
+	stats, _ := CreateStatsWith(root, IncludeAll)
+	if _, ok := stats[MetaDir]; ok || len(stats) != 2 {
+		t.Errorf("Trash scanned: %v", SortedKeys(stats))
+	}
+
+	// the index survives a reload
+	if err := trash.Save(); err != nil {
+		t.Fatal(err)
+	}
+	trash, err = OpenTrash(root)
+	if err != nil || len(trash.Entries) != 1 || trash.Entries[0].Path != f1 || !trash.Entries[0].ModTime.Equal(mtime) {
+		t.Fatalf("Unexpected trash %+v (%v)", trash, err)
+	}
+
+	os.WriteFile(filepath.Join(root, f1), []byte("new"), 0644)
+	if err := trash.Restore(f1); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(filepath.Join(root, f1))
+	info, _ := os.Stat(filepath.Join(root, f1))
+	if string(content) != "old" || !info.ModTime().Equal(mtime) {
+		t.Errorf("Restored %q modified %v", content, info.ModTime())
+	}
+	if len(trash.Entries) != 1 || trash.Entries[0].Reason != "restored over" {
+		t.Errorf("Replaced file not trashed: %+v", trash.Entries)
+	}
+	if err := trash.Restore("f2.txt"); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("Expected ErrNotInTrash, got %v", err)
+	}
+}
+
+func TestTrashPrune(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_trash"})
+	MakePlayground(root, []string{""})
+	defer os.RemoveAll(root)
+
+	trash, _ := OpenTrash(root)
+	for i, age := range []int{10, 9, 2, 1} {
+		name := string(rune('a' + i))
+		os.WriteFile(filepath.Join(root, name), make([]byte, 10), 0644)
+		trash.Move(name, "deleted")
+		trash.Entries[i].Trashed = time.Now().AddDate(0, 0, -age)
+	}
+
+	pruned, err := trash.Prune(Retention{})
+	if err != nil || len(pruned) != 0 {
+		t.Errorf("Unbounded retention pruned %v (%v)", pruned, err)
+	}
+	pruned, _ = trash.Prune(Retention{Days: 8})
+	if len(pruned) != 2 || pruned[0].Path != "a" {
+		t.Errorf("Expected a and b expired, got %+v", pruned)
+	}
+	pruned, _ = trash.Prune(Retention{MaxSize: 15})
+	if len(pruned) != 1 || pruned[0].Path != "c" || len(trash.Entries) != 1 {
+		t.Errorf("Expected c pruned for size, got %+v", pruned)
+	}
+	if _, err := os.Stat(filepath.Join(root, TrashDir, archiveFiles, pruned[0].File)); err == nil {
+		t.Errorf("Pruned file still in the trash")
+	}
+}
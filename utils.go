@@ -1,5 +1,6 @@
 package atf
 import (
+	"bytes"
 	"flag"
 	"hash/fnv"
 	"io"
@@ -8,6 +9,11 @@ import (
 	"strings"
 	"strconv"
 	"os"
+	"time"
+
+	dc "github.com/leogem2003/directchan"
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/term"
 )
 
 // Join path parts using OS separator
@@ -27,17 +33,27 @@ func GetTmpName(suffix []string) string {
 
 var DefaultSettings = PathJoin([]string{os.Getenv("HOME"), ".config", "allthoughtsfile", "settings.json"})
 
-func SettingsFlag(target *string) {
-	flag.StringVar(target, "settings", DefaultSettings, "path to settings.json")
+func SettingsFlag(flags *flag.FlagSet, target *string) {
+	flags.StringVar(target, "settings", DefaultSettings, "path to settings.json")
+}
+
+
+func DebugFlag(flags *flag.FlagSet, target *bool) {
+	flags.BoolVar(target, "debug", false, "enable debugging")
 }
 
+func AESFlag(flags *flag.FlagSet, target *string) {
+	flags.StringVar(target, "aes", "", "shared key file authenticating the peer")
+}
 
-func DebugFlag(target *bool) {
-	flag.BoolVar(target, "debug", false, "enable debugging")
+func PassphraseFlag(flags *flag.FlagSet, target *bool) {
+	flags.BoolVar(target, "passphrase", false,
+		"authenticate the peer with a passphrase read from the terminal (or $"+PassphraseEnv+")")
 }
 
-func AESFlag(target *string) {
-	flag.StringVar(target, "aes", "", "AES key file")
+func ProgressFlag(flags *flag.FlagSet, target *bool) {
+	flags.BoolVar(target, "progress", term.IsTerminal(int(os.Stderr.Fd())),
+		"show the progress of transfers on stderr, by default only if it is a terminal")
 }
 
 func SetDebugMode(debug bool) {
@@ -65,3 +81,62 @@ func RemovePrefix(p string, l []string) []string {
 	}
 	return result
 }
+
+// Message ending a session, see EndSession
+var BYE = []byte(":BYE")
+
+// Longest wait for the peer to end the session
+const ByeTimeout = 5 * time.Second
+
+// Logs the state changes of conn, returning a channel closed once the
+// connection with the peer is over
+func WatchState(conn *dc.Connection) <-chan struct{} {
+	over := make(chan struct{})
+	go func() {
+		ended := false
+		for state := range conn.State {
+			log.Printf("conn state changed: %v", state)
+			switch state {
+			case webrtc.PeerConnectionStateDisconnected,
+				webrtc.PeerConnectionStateFailed,
+				webrtc.PeerConnectionStateClosed:
+				if !ended {
+					close(over)
+					ended = true
+				}
+			}
+		}
+	}()
+	return over
+}
+
+// Tells the peer that the session on c is over and waits for it to say
+// the same, to close the connection, which it only does once it heard
+// from this side, or for ByeTimeout. Closing right after the last Send
+// may drop messages the peer is still waiting for: they come before its
+// goodbye. Other messages received meanwhile are dropped.
+func EndSession(c dc.IOChannel, over <-chan struct{}) {
+	c.Send(BYE)
+	bye := make(chan struct{})
+	go func() {
+		defer close(bye)
+		for {
+			msg := c.Recv()
+			if msg == nil || bytes.Equal(msg, BYE) {
+				return
+			}
+		}
+	}()
+	select {
+	case <-bye:
+	case <-over:
+	case <-time.After(ByeTimeout):
+		log.Print("The peer did not end the session")
+	}
+}
+
+// Ends the session on conn, then closes it
+func CloseGracefully(conn *dc.Connection, over <-chan struct{}) error {
+	EndSession(conn, over)
+	return conn.CloseAll()
+}
@@ -0,0 +1,34 @@
+package atf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndSession(t *testing.T) {
+	p1, p2 := MakePipes(4)
+	// a late message of the session is dropped
+	p2.Send([]byte("late"))
+	done := make(chan struct{})
+	go func() {
+		EndSession(p1, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Session ended before the peer said goodbye")
+	case <-time.After(50 * time.Millisecond):
+	}
+	EndSession(p2, nil)
+	<-done
+
+	// nor is the peer waited for once the connection is over
+	p1, _ = MakePipes(4)
+	over := make(chan struct{})
+	close(over)
+	start := time.Now()
+	EndSession(p1, over)
+	if time.Since(start) >= ByeTimeout {
+		t.Errorf("Waited for the peer of a closed connection")
+	}
+}
@@ -0,0 +1,219 @@
+package atf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Directory of a folder holding the older versions of its files
+var VersionsDir = filepath.Join(MetaDir, "versions")
+
+// Versions kept when none is configured
+const DefaultVersionsDays = 365
+
+// Older version of a file, replaced by the one of a peer
+type FileVersion struct {
+	Path     string    `json:"path"` // relative to the folder
+	File     string    `json:"file"` // relative to the files of the versions
+	Archived time.Time `json:"archived"`
+	ModTime  time.Time `json:"mod_time"`
+	Size     int64     `json:"size"`
+	Source   string    `json:"source,omitempty"` // fingerprint of the device that wrote it, "" if local
+}
+
+// Staggered versions of the files of a folder, as in Syncthing: the
+// older a version, the fewer versions around it are kept.
+type Versions struct {
+	dir string
+
+	Versions []FileVersion     `json:"versions"` // oldest first
+	Origins  map[string]string `json:"origins"`  // device that wrote each received file
+}
+
+// Spacing of the versions kept, by age: one version every Interval for
+// versions younger than Until
+var versionSpacing = []struct{ Until, Interval time.Duration }{
+	{time.Hour, 30 * time.Second},
+	{24 * time.Hour, time.Hour},
+	{30 * 24 * time.Hour, 24 * time.Hour},
+}
+
+// Spacing of the versions older than a month
+const versionWeekly = 7 * 24 * time.Hour
+
+// Opens the versions of the folder dir, empty if missing
+func OpenVersions(dir string) (*Versions, error) {
+	v := &Versions{dir: dir}
+	if err := loadIndex(v.path(archiveIndex), v); err != nil {
+		return nil, err
+	}
+	if v.Origins == nil {
+		v.Origins = make(map[string]string)
+	}
+	return v, nil
+}
+
+func (v *Versions) path(parts ...string) string {
+	return filepath.Join(append([]string{v.dir, VersionsDir}, parts...)...)
+}
+
+// Writes the index of the versions
+func (v *Versions) Save() error {
+	return saveIndex(v.path(), v, len(v.Versions) == 0 && len(v.Origins) == 0)
+}
+
+// Records that the content of rel was written by device, "" for the
+// local one
+func (v *Versions) SetOrigin(rel, device string) {
+	if device == "" {
+		delete(v.Origins, rel)
+	} else {
+		v.Origins[rel] = device
+	}
+}
+
+// Moves the file rel of the folder to the versions.
+// A missing file is not an error.
+func (v *Versions) Archive(rel string) error {
+	now := time.Now().UTC()
+	file, info, err := stashFile(v.dir, v.path(archiveFiles), rel, now)
+	if err != nil || info == nil {
+		return err
+	}
+	v.Versions = append(v.Versions, FileVersion{
+		Path:     rel,
+		File:     file,
+		Archived: now,
+		ModTime:  info.ModTime().UTC(),
+		Size:     info.Size(),
+		Source:   v.Origins[rel],
+	})
+	return nil
+}
+
+// Returns the versions of rel, newest first
+func (v *Versions) History(rel string) []FileVersion {
+	rel = filepath.Clean(rel)
+	history := make([]FileVersion, 0)
+	for _, version := range slices.Backward(v.Versions) {
+		if version.Path == rel {
+			history = append(history, version)
+		}
+	}
+	return history
+}
+
+// Copies the n-th version of rel, 1 being the newest, back into the
+// folder as a new local change: its modification time is now, so that
+// it wins over the copies of the peers. The current file is archived.
+func (v *Versions) Restore(rel string, n int) error {
+	rel = filepath.Clean(rel)
+	history := v.History(rel)
+	if n < 1 || n > len(history) {
+		return fmt.Errorf("%s has %d versions, no version %d", rel, len(history), n)
+	}
+	return v.restore(history[n-1])
+}
+
+// Restores the version of rel kept in file, as Restore does
+func (v *Versions) RestoreFile(rel, file string) error {
+	rel = filepath.Clean(rel)
+	for _, version := range v.History(rel) {
+		if version.File == file {
+			return v.restore(version)
+		}
+	}
+	return fmt.Errorf("the version of %s is no longer kept", rel)
+}
+
+func (v *Versions) restore(version FileVersion) error {
+	rel := version.Path
+	dst, err := SafeJoin(v.dir, rel)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(v.path(archiveFiles, version.File))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	partial := PartialName(dst)
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = v.Archive(rel)
+	}
+	if err == nil {
+		err = os.Rename(partial, dst)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	v.SetOrigin(rel, "")
+	return nil
+}
+
+// Deletes the versions older than maxAge, and the ones too close to a
+// newer version for their age. Returns the versions deleted.
+func (v *Versions) Thin(maxAge time.Duration, now time.Time) ([]FileVersion, error) {
+	lastKept := make(map[string]time.Time) // newest version kept, by path
+	drop := make(map[int]bool)
+	for i, version := range slices.Backward(v.Versions) {
+		age := now.Sub(version.Archived)
+		if age > maxAge {
+			drop[i] = true
+			continue
+		}
+		interval := versionWeekly
+		for _, s := range versionSpacing {
+			if age < s.Until {
+				interval = s.Interval
+				break
+			}
+		}
+		last, ok := lastKept[version.Path]
+		if ok && last.Sub(version.Archived) < interval {
+			drop[i] = true
+			continue
+		}
+		lastKept[version.Path] = version.Archived
+	}
+
+	thinned := make([]FileVersion, 0, len(drop))
+	kept := make([]FileVersion, 0, len(v.Versions)-len(drop))
+	var err error
+	for i, version := range v.Versions {
+		if !drop[i] || err != nil {
+			kept = append(kept, version)
+			continue
+		}
+		removeErr := os.Remove(v.path(archiveFiles, version.File))
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+			kept = append(kept, version)
+			continue
+		}
+		thinned = append(thinned, version)
+	}
+	v.Versions = kept
+	return thinned, err
+}
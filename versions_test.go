@@ -0,0 +1,108 @@
+package atf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	root := GetTmpName([]string{"atf", "test_versions"})
+	MakePlayground(root, []string{"a/f.txt"})
+	defer os.RemoveAll(root)
+	f := filepath.Join("a", "f.txt")
+	path := filepath.Join(root, f)
+
+	versions, err := OpenVersions(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"v1", "v2", "v3"} {
+		os.WriteFile(path, []byte(content), 0644)
+		if err := versions.Archive(f); err != nil {
+			t.Fatal(err)
+		}
+		versions.SetOrigin(f, "peer-"+content)
+	}
+	os.WriteFile(path, []byte("current"), 0644)
+	if err := versions.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err = OpenVersions(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := versions.History(f)
+	if len(history) != 3 || history[0].Size != 2 || history[0].Source != "peer-v2" || history[2].Source != "" {
+		t.Fatalf("Unexpected history %+v", history)
+	}
+
+	if err := versions.Restore(f, 4); err == nil {
+		t.Errorf("Restored a missing version")
+	}
+	before := time.Now().Add(-time.Second)
+	if err := versions.Restore(f, 3); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(path)
+	info, _ := os.Stat(path)
+	if string(content) != "v1" || info.ModTime().Before(before) {
+		t.Errorf("Restored %q modified %v", content, info.ModTime())
+	}
+	// the replaced file is a version too, the restored one is kept
+	if history := versions.History(f); len(history) != 4 || history[0].Size != int64(len("current")) {
+		t.Errorf("Unexpected history after restore %+v", history)
+	}
+	if _, ok := versions.Origins[f]; ok {
+		t.Errorf("A restored file is a local change")
+	}
+
+	// a version is found by its file, whatever came after it
+	v2 := versions.History(f)[2]
+	if err := versions.RestoreFile(f, v2.File); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "v2" {
+		t.Errorf("Restored %q instead of v2", content)
+	}
+	if err := versions.RestoreFile(f, "missing"); err == nil {
+		t.Errorf("Restored a missing version")
+	}
+}
+
+func TestVersionsThin(t *testing.T) {
+	now := time.Now()
+	versions := &Versions{dir: t.TempDir()}
+	ages := []time.Duration{
+		400 * 24 * time.Hour, // too old
+		60 * 24 * time.Hour,  // within a week of a newer one
+		59 * 24 * time.Hour,
+		10*24*time.Hour + time.Hour, // within a day of a newer one
+		10 * 24 * time.Hour,
+		5 * time.Hour,
+		4 * time.Hour,
+		2 * time.Minute,
+		time.Minute, // within 30 seconds of a newer one
+		50 * time.Second,
+	}
+	for _, age := range ages {
+		versions.Versions = append(versions.Versions, FileVersion{Path: "f", Archived: now.Add(-age)})
+	}
+	versions.Versions = append(versions.Versions, FileVersion{Path: "g", Archived: now.Add(-59 * 24 * time.Hour)})
+
+	thinned, err := versions.Thin(DefaultVersionsDays*24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thinned) != 4 || len(versions.Versions) != len(ages)+1-4 {
+		t.Errorf("Expected 4 versions thinned, got %+v", thinned)
+	}
+	for _, v := range thinned {
+		age := now.Sub(v.Archived)
+		if v.Path != "f" || (age != ages[0] && age != ages[1] && age != ages[3] && age != ages[8]) {
+			t.Errorf("Unexpected version thinned, %v old", age)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package atf
+
+// Words making up wormhole codes: 256 of them, so that each word
+// carries 8 bits of entropy. Kept short, distinct and easy to spell.
+var codeWords = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "album", "alien", "alpha",
+	"amber", "anchor", "angel", "ankle", "apple", "apron", "arena", "armor",
+	"arrow", "atlas", "atom", "attic", "autumn", "badge", "bagel", "baker",
+	"bamboo", "banjo", "barrel", "basil", "basket", "beacon", "beaver", "bench",
+	"berry", "bison", "blanket", "blossom", "bonsai", "border", "bottle", "breeze",
+	"brick", "bridge", "bronze", "bubble", "bucket", "bugle", "button", "cabin",
+	"cactus", "camel", "candle", "canoe", "canyon", "captain", "carbon", "carpet",
+	"castle", "cedar", "cello", "chalk", "cherry", "chess", "chimney", "cinema",
+	"circus", "citrus", "clover", "cobalt", "cocoa", "comet", "compass", "copper",
+	"coral", "cotton", "cougar", "crayon", "cricket", "crystal", "curtain", "cycle",
+	"dahlia", "daisy", "dancer", "delta", "desert", "diesel", "dingo", "dolphin",
+	"domino", "donkey", "dragon", "drum", "eagle", "echo", "eclipse", "elbow",
+	"ember", "engine", "falcon", "feather", "ferry", "fiddle", "flute", "forest",
+	"fossil", "fox", "galaxy", "garden", "garlic", "gecko", "geyser", "ginger",
+	"glacier", "globe", "goblet", "gopher", "granite", "grape", "guitar", "hammer",
+	"harbor", "harp", "hazel", "helmet", "hermit", "honey", "horizon", "hornet",
+	"iceberg", "igloo", "indigo", "island", "ivory", "jacket", "jaguar", "jasmine",
+	"jelly", "jigsaw", "jungle", "kayak", "kernel", "kettle", "kiwi", "koala",
+	"ladder", "lagoon", "lantern", "laser", "lemon", "lentil", "lily", "lizard",
+	"lobster", "locket", "lotus", "magnet", "mango", "maple", "marble", "meadow",
+	"melon", "meteor", "mint", "mirror", "monkey", "mosaic", "muffin", "nectar",
+	"needle", "nickel", "nutmeg", "oasis", "ocean", "olive", "onion", "orbit",
+	"orchid", "otter", "oyster", "paddle", "panda", "panther", "paper", "parrot",
+	"peach", "pebble", "pelican", "pepper", "piano", "pickle", "pilot", "pine",
+	"planet", "plum", "pocket", "polar", "pony", "potato", "prism", "pumpkin",
+	"puzzle", "quartz", "quill", "rabbit", "radar", "radio", "raven", "ribbon",
+	"river", "robin", "rocket", "saddle", "safari", "salmon", "sandal", "satin",
+	"scarf", "shadow", "sierra", "silver", "sketch", "sparrow", "spider", "spruce",
+	"squid", "stable", "statue", "summer", "sunset", "swan", "tango", "teapot",
+	"tiger", "timber", "toast", "tomato", "topaz", "torch", "tulip", "tundra",
+	"turtle", "valley", "velvet", "violin", "volcano", "waffle", "walnut", "walrus",
+	"willow", "window", "winter", "wizard", "yacht", "yogurt", "zebra", "zephyr",
+}
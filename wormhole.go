@@ -0,0 +1,197 @@
+package atf
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"filippo.io/nistec"
+	dc "github.com/leogem2003/directchan"
+)
+
+// Wormhole codes have the form <nameplate>-<word>-<word>, e.g.
+// 7-guitar-orbit. The nameplate only picks the signaling room, the whole
+// code is the password of a SPAKE2 exchange: an attacker gets a single
+// online guess per transfer, and nothing to attack offline.
+
+// Highest nameplate handed out by GenerateCode
+const MaxNameplate = 999
+
+// Number of words in a generated code
+const CodeWords = 2
+
+var ErrBadCode = errors.New("wormhole code mismatch: check the code and try again")
+
+var wordIndex = func() map[string]bool {
+	index := make(map[string]bool, len(codeWords))
+	for _, w := range codeWords {
+		index[w] = true
+	}
+	return index
+}()
+
+// Returns a fresh random wormhole code
+func GenerateCode() (string, error) {
+	nameplate, err := rand.Int(rand.Reader, big.NewInt(MaxNameplate))
+	if err != nil {
+		return "", err
+	}
+	parts := []string{strconv.FormatInt(nameplate.Int64()+1, 10)}
+	for range CodeWords {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeWords))))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, codeWords[i.Int64()])
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// Normalizes a code typed by the user and returns it with its nameplate.
+// Words outside the list are refused, as they can only be typos.
+func ParseCode(code string) (normalized, nameplate string, err error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(code)), "-")
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("malformed code %q: expected <number>-<word>-<word>", code)
+	}
+	if n, err := strconv.Atoi(parts[0]); err != nil || n <= 0 {
+		return "", "", fmt.Errorf("malformed code %q: %q is not a nameplate", code, parts[0])
+	}
+	for _, w := range parts[1:] {
+		if !wordIndex[w] {
+			return "", "", fmt.Errorf("malformed code %q: unknown word %q", code, w)
+		}
+	}
+	return strings.Join(parts, "-"), parts[0], nil
+}
+
+// Signaling key of the room where the peers holding a code meet
+func WormholeRoom(nameplate string) string {
+	return "atf-wormhole-" + nameplate
+}
+
+// SPAKE2 over P-256, as specified by RFC 9382
+var (
+	spakeM = mustPoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f")
+	spakeN = mustPoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+)
+
+// Order of the P-256 group
+var p256Order, _ = new(big.Int).SetString("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551", 16)
+
+func mustPoint(compressed string) *nistec.P256Point {
+	b, err := hex.DecodeString(compressed)
+	if err != nil {
+		panic(err)
+	}
+	p, err := nistec.NewP256Point().SetBytes(b)
+	if err != nil {
+		panic("point not on curve: " + compressed)
+	}
+	return p
+}
+
+// Runs SPAKE2 over c with code as password and returns the cypher of the
+// session. The sender and the receiver play the two roles of the
+// protocol, so exactly one peer must set sender.
+// Both sides end by checking the key confirmation of the other: with
+// different codes, both fail with ErrBadCode.
+func Wormhole(c dc.IOChannel, code string, sender bool) (*dc.AESGCM, error) {
+	n := p256Order
+	digest := sha512.Sum512([]byte("allthoughtsfile wormhole\x00" + code))
+	w := new(big.Int).Mod(new(big.Int).SetBytes(digest[:]), n)
+	own, peer := spakeM, spakeN
+	if !sender {
+		own, peer = spakeN, spakeM
+	}
+
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	x.Add(x, big.NewInt(1))
+
+	// share = x*G + w*own
+	gx, err := nistec.NewP256Point().ScalarBaseMult(scalar(x))
+	if err != nil {
+		return nil, err
+	}
+	mw, err := nistec.NewP256Point().ScalarMult(own, scalar(w))
+	if err != nil {
+		return nil, err
+	}
+	share := nistec.NewP256Point().Add(gx, mw).BytesCompressed()
+	c.Send(share)
+
+	peerShare := c.Recv()
+	// the point at infinity is refused along with any other encoding
+	if len(peerShare) != len(share) {
+		return nil, errors.New("invalid key share from peer")
+	}
+	p, err := nistec.NewP256Point().SetBytes(peerShare)
+	if err != nil {
+		return nil, errors.New("invalid key share from peer")
+	}
+
+	// K = x*(peerShare - w*peer), subtracting by adding (n-w)*peer
+	nw, err := nistec.NewP256Point().ScalarMult(peer, scalar(new(big.Int).Sub(n, w)))
+	if err != nil {
+		return nil, err
+	}
+	k, err := nistec.NewP256Point().ScalarMult(p.Add(p, nw), scalar(x))
+	if err != nil {
+		return nil, err
+	}
+	kBytes := k.Bytes()
+	if len(kBytes) == 1 {
+		return nil, errors.New("invalid key share from peer")
+	}
+
+	shareA, shareB := share, peerShare
+	if !sender {
+		shareA, shareB = peerShare, share
+	}
+	var transcript []byte
+	for _, m := range [][]byte{
+		[]byte("sender"), []byte("receiver"), shareA, shareB,
+		kBytes, scalar(w),
+	} {
+		transcript = binary.LittleEndian.AppendUint64(transcript, uint64(len(m)))
+		transcript = append(transcript, m...)
+	}
+	keys := sha512.Sum512(transcript)
+	ke, ka := keys[:32], keys[32:]
+
+	kc, err := hkdf.Key(sha256.New, ka, nil, "ConfirmationKeys", 64)
+	if err != nil {
+		return nil, err
+	}
+	confirmation := func(key []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(transcript)
+		return mac.Sum(nil)
+	}
+	ownKey, peerKey := kc[:32], kc[32:]
+	if !sender {
+		ownKey, peerKey = peerKey, ownKey
+	}
+	c.Send(confirmation(ownKey))
+	if !hmac.Equal(c.Recv(), confirmation(peerKey)) {
+		return nil, ErrBadCode
+	}
+	return dc.NewAESGCM(ke)
+}
+
+// Big-endian encoding of a scalar, padded to the curve size
+func scalar(k *big.Int) []byte {
+	return k.FillBytes(make([]byte, 32))
+}
@@ -0,0 +1,64 @@
+package atf
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func runWormholes(code1, code2 string) (error, error) {
+	p1, p2 := MakePipes(4)
+	errs := make(chan error, 1)
+	msg := []byte("hello")
+	go func() {
+		cypher, err := Wormhole(p1, code1, true)
+		if err == nil {
+			NewSecureChannel(p1, cypher).Send(msg)
+		}
+		errs <- err
+	}()
+	cypher, err2 := Wormhole(p2, code2, false)
+	err1 := <-errs
+	if err1 == nil && err2 == nil {
+		if got := NewSecureChannel(p2, cypher).Recv(); !slices.Equal(got, msg) {
+			err2 = errors.New("peers derived different keys")
+		}
+	}
+	return err1, err2
+}
+
+func TestWormhole(t *testing.T) {
+	code, err := GenerateCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err1, err2 := runWormholes(code, code); err1 != nil || err2 != nil {
+		t.Errorf("Wormhole with code %s failed: %v, %v", code, err1, err2)
+	}
+
+	err1, err2 := runWormholes("7-guitar-orbit", "7-guitar-otter")
+	if !errors.Is(err1, ErrBadCode) || !errors.Is(err2, ErrBadCode) {
+		t.Errorf("Expected code mismatch, got %v, %v", err1, err2)
+	}
+}
+
+func TestParseCode(t *testing.T) {
+	code, err := GenerateCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if normalized, _, err := ParseCode(code); err != nil || normalized != code {
+		t.Errorf("Generated code %s refused: %v", code, err)
+	}
+
+	normalized, nameplate, err := ParseCode("  42-Guitar-ORBIT\n")
+	if err != nil || normalized != "42-guitar-orbit" || nameplate != "42" {
+		t.Errorf("Unexpected parse: %s %s %v", normalized, nameplate, err)
+	}
+
+	for _, bad := range []string{"", "42", "guitar-orbit", "0-guitar", "42-guitar-orbitt"} {
+		if _, _, err := ParseCode(bad); err == nil {
+			t.Errorf("Malformed code %q accepted", bad)
+		}
+	}
+}